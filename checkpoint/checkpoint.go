@@ -0,0 +1,319 @@
+// Package checkpoint contains utilities for persisting the delivery progress
+// and the follow graph, so that the server can recover after a restart.
+//
+// A checkpoint file is laid out as follows, integers are big-endian:
+//
+//	magic "EQCP" | version uint16 | uid mode uint8 | index uint64 | number of users uint64
+//	for each user: uid | number of followers uint64 | follower uids...
+//	crc32 (IEEE) of everything preceding it
+//
+// UIDs are written as uint64 in client.NumericUIDs mode and as their length
+// in uint16 followed by the string in client.StringUIDs mode, since interned
+// UIDs don't survive a restart. Version 1 lacks the uid mode and is numeric.
+package checkpoint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"../client"
+	"../log"
+)
+
+const (
+	magic = "EQCP"
+
+	// Version is the current version of the on-disk format.
+	Version uint16 = 2
+)
+
+var (
+	IncorrectFormatError    = errors.New("checkpoint is formatted incorrectly")
+	UnsupportedVersionError = errors.New("checkpoint version is not supported")
+	ChecksumMismatchError   = errors.New("checkpoint checksum doesn't match its content")
+	UIDModeMismatchError    = errors.New("checkpoint uid mode doesn't match the server")
+)
+
+// State is a snapshot of the delivery progress and the follow graph.
+type State struct {
+	// Index is the sequence number of the next packet to be delivered.
+	Index uint64
+
+	// Followers contains the followers of each user.
+	Followers map[client.UID]client.UIDSet
+}
+
+// Encode writes the given state to w in the checkpoint format.
+func Encode(w io.Writer, s *State) error {
+	var buf bytes.Buffer
+
+	buf.WriteString(magic)
+
+	put := func(v interface{}) {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+
+	putUID := func(uid client.UID) {
+		if client.Mode == client.NumericUIDs {
+			put(uint64(uid))
+			return
+		}
+
+		name := uid.String()
+
+		put(uint16(len(name)))
+		buf.WriteString(name)
+	}
+
+	put(Version)
+	put(uint8(client.Mode))
+	put(s.Index)
+	put(uint64(len(s.Followers)))
+
+	for _, uid := range sorted(s.Followers) {
+		followers := s.Followers[uid]
+
+		putUID(uid)
+		put(uint64(len(followers)))
+
+		for _, follower := range sortedSet(followers) {
+			putUID(follower)
+		}
+	}
+
+	put(crc32.ChecksumIEEE(buf.Bytes()))
+
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
+
+// Decode reads a state in the checkpoint format from r and verifies it.
+func Decode(r io.Reader) (*State, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < len(magic)+2+4 || string(buf[:len(magic)]) != magic {
+		return nil, IncorrectFormatError
+	}
+
+	content, checksum := buf[:len(buf)-4], buf[len(buf)-4:]
+
+	version := binary.BigEndian.Uint16(content[len(magic):])
+	if version < 1 || version > Version {
+		return nil, UnsupportedVersionError
+	}
+
+	if crc32.ChecksumIEEE(content) != binary.BigEndian.Uint32(checksum) {
+		return nil, ChecksumMismatchError
+	}
+
+	rdr := bytes.NewReader(content[len(magic)+2:])
+
+	read := func(v interface{}) {
+		if err == nil {
+			err = binary.Read(rdr, binary.BigEndian, v)
+		}
+	}
+
+	next := func() (n uint64) {
+		read(&n)
+
+		return n
+	}
+
+	mode := uint8(client.NumericUIDs)
+	if version > 1 {
+		read(&mode)
+	}
+
+	if err == nil && client.UIDMode(mode) != client.Mode {
+		return nil, UIDModeMismatchError
+	}
+
+	nextUID := func() client.UID {
+		if client.Mode == client.NumericUIDs {
+			return client.UID(next())
+		}
+
+		var n uint16
+		read(&n)
+
+		name := make([]byte, n)
+		if err == nil {
+			_, err = io.ReadFull(rdr, name)
+		}
+
+		if err != nil {
+			return 0
+		}
+
+		var uid client.UID
+		uid, err = client.ParseUID(name)
+
+		return uid
+	}
+
+	s := &State{
+		Index:     next(),
+		Followers: make(map[client.UID]client.UIDSet),
+	}
+
+	for users := next(); err == nil && users > 0; users-- {
+		uid, followers := nextUID(), make(client.UIDSet)
+
+		for n := next(); err == nil && n > 0; n-- {
+			followers.Add(nextUID())
+		}
+
+		s.Followers[uid] = followers
+	}
+
+	if err != nil || rdr.Len() != 0 {
+		return nil, IncorrectFormatError
+	}
+
+	return s, nil
+}
+
+// Save atomically replaces the checkpoint file at the given path with the state.
+func Save(path string, s *State) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if err := Encode(f, s); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Load reads the checkpoint file at the given path.
+func Load(path string) (*State, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return Decode(f)
+}
+
+// Writer creates a goroutine that saves the states it receives to the
+// checkpoint file at the given path and returns a channel for sending them.
+// Sends never block, a state is dropped if the previous one is still being saved.
+func Writer(path string) chan<- *State {
+	stateCh := make(chan *State, 1)
+
+	go func() {
+		for s := range stateCh {
+			if err := Save(path, s); err != nil {
+				log.Error(fmt.Sprintf("checkpoint.Writer: while saving to %#q, got error %#q", path, err))
+			}
+		}
+	}()
+
+	return stateCh
+}
+
+// SnapshotFunc returns a client.RegistryFunc that takes a snapshot of the
+// follow graph when invoked and sends it along with the given index to stateCh.
+// It is meant to be sent to the registry right after the packet preceding
+// the index, so that the snapshot is consistent with the index.
+func SnapshotFunc(index uint64, stateCh chan<- *State) client.RegistryFunc {
+	return func(clients client.Registry) error {
+		s := &State{
+			Index:     index,
+			Followers: make(map[client.UID]client.UIDSet, len(clients)),
+		}
+
+		for uid, session := range clients {
+			if session == nil || len(session.Followers) == 0 {
+				continue
+			}
+
+			followers := make(client.UIDSet, len(session.Followers))
+			for follower := range session.Followers {
+				followers.Add(follower)
+			}
+
+			s.Followers[uid] = followers
+		}
+
+		select {
+		case stateCh <- s:
+		default:
+			log.Debug(fmt.Sprintf("checkpoint.SnapshotFunc: previous checkpoint is still being saved, dropped checkpoint %v", index))
+		}
+
+		return nil
+	}
+}
+
+// RestoreFunc returns a client.RegistryFunc that restores the
+// follow graph of the given state when invoked.
+// Users that aren't connected are registered as inactive.
+func RestoreFunc(s *State) client.RegistryFunc {
+	return func(clients client.Registry) error {
+		for uid, followers := range s.Followers {
+			if _, ok := clients[uid]; !ok {
+				clients[uid] = &client.Session{
+					Followers: make(client.UIDSet),
+				}
+			}
+
+			for follower := range followers {
+				clients[uid].Followers.Add(follower)
+			}
+		}
+
+		return nil
+	}
+}
+
+func sorted(m map[client.UID]client.UIDSet) []client.UID {
+	UIDs := make([]client.UID, 0, len(m))
+	for uid := range m {
+		UIDs = append(UIDs, uid)
+	}
+
+	sort.Slice(UIDs, func(i, j int) bool { return UIDs[i] < UIDs[j] })
+
+	return UIDs
+}
+
+func sortedSet(set client.UIDSet) []client.UID {
+	UIDs := make([]client.UID, 0, len(set))
+	for uid := range set {
+		UIDs = append(UIDs, uid)
+	}
+
+	sort.Slice(UIDs, func(i, j int) bool { return UIDs[i] < UIDs[j] })
+
+	return UIDs
+}
@@ -0,0 +1,209 @@
+package checkpoint_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"."
+	"../client"
+)
+
+func sampleState() *checkpoint.State {
+	return &checkpoint.State{
+		Index: 184467,
+		Followers: map[client.UID]client.UIDSet{
+			15: {2: {}, 92: {}},
+			71: {87: {}},
+			2:  {},
+		},
+	}
+}
+
+func TestEncodesAndDecodesState(t *testing.T) {
+	var buf bytes.Buffer
+
+	state := sampleState()
+	if err := checkpoint.Encode(&buf, state); err != nil {
+		t.Fatalf("checkpoint.Encode(%+v) got error %v", state, err)
+	}
+
+	got, err := checkpoint.Decode(&buf)
+	if err != nil {
+		t.Fatalf("checkpoint.Decode(checkpoint.Encode(%+v)) got error %v", state, err)
+	}
+
+	if !reflect.DeepEqual(state, got) {
+		t.Errorf("checkpoint.Decode(checkpoint.Encode(%+v)) got %+v", state, got)
+	}
+}
+
+func TestRejectsCorruptedCheckpoints(t *testing.T) {
+	var buf bytes.Buffer
+	if err := checkpoint.Encode(&buf, sampleState()); err != nil {
+		t.Fatalf("checkpoint.Encode got error %v", err)
+	}
+
+	valid := buf.Bytes()
+
+	corrupt := func(i int, b byte) []byte {
+		buf := append([]byte(nil), valid...)
+		buf[i] = b
+
+		return buf
+	}
+
+	tests := []struct {
+		buf []byte
+		err error
+	}{
+		{[]byte(""), checkpoint.IncorrectFormatError},
+		{[]byte("EQCX"), checkpoint.IncorrectFormatError},
+		{corrupt(0, 'X'), checkpoint.IncorrectFormatError},
+		{corrupt(5, 3), checkpoint.UnsupportedVersionError},
+		{corrupt(10, 0xFF), checkpoint.ChecksumMismatchError},
+		{valid[:len(valid)-1], checkpoint.ChecksumMismatchError},
+	}
+
+	for _, testCase := range tests {
+		if _, err := checkpoint.Decode(bytes.NewReader(testCase.buf)); err != testCase.err {
+			t.Errorf("checkpoint.Decode(%q) expected error %v, got %v", testCase.buf, testCase.err, err)
+		}
+	}
+}
+
+func TestDecodesVersion1Checkpoints(t *testing.T) {
+	var buf bytes.Buffer
+
+	buf.WriteString("EQCP")
+
+	for _, v := range []interface{}{uint16(1), uint64(42), uint64(1), uint64(15), uint64(1), uint64(92)} {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	expected := &checkpoint.State{
+		Index:     42,
+		Followers: map[client.UID]client.UIDSet{15: {92: {}}},
+	}
+
+	got, err := checkpoint.Decode(&buf)
+	if err != nil {
+		t.Fatalf("checkpoint.Decode(version 1) got error %v", err)
+	}
+
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("checkpoint.Decode(version 1) expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestEncodesStringUIDs(t *testing.T) {
+	defer func(mode client.UIDMode) {
+		client.Mode = mode
+	}(client.Mode)
+
+	client.Mode = client.StringUIDs
+
+	uid := func(name string) client.UID {
+		uid, err := client.ParseUID([]byte(name))
+		if err != nil {
+			t.Fatalf("client.ParseUID(%#q) got error %v", name, err)
+		}
+
+		return uid
+	}
+
+	state := &checkpoint.State{
+		Index: 7,
+		Followers: map[client.UID]client.UIDSet{
+			uid("alice"): {uid("bob"): {}, uid("çağrı"): {}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := checkpoint.Encode(&buf, state); err != nil {
+		t.Fatalf("checkpoint.Encode(%+v) got error %v", state, err)
+	}
+
+	if !bytes.Contains(buf.Bytes(), []byte("alice")) {
+		t.Errorf("checkpoint.Encode(%+v) expected string UIDs to be written, got %q", state, buf.Bytes())
+	}
+
+	encoded := buf.Bytes()
+
+	got, err := checkpoint.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("checkpoint.Decode(checkpoint.Encode(%+v)) got error %v", state, err)
+	}
+
+	if !reflect.DeepEqual(state, got) {
+		t.Errorf("checkpoint.Decode(checkpoint.Encode(%+v)) got %+v", state, got)
+	}
+
+	client.Mode = client.NumericUIDs
+
+	if _, err := checkpoint.Decode(bytes.NewReader(encoded)); err != checkpoint.UIDModeMismatchError {
+		t.Errorf("checkpoint.Decode in numeric mode expected error %v, got %v", checkpoint.UIDModeMismatchError, err)
+	}
+}
+
+func TestSavesAndLoadsCheckpointFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir got error %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state")
+
+	if _, err := checkpoint.Load(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint.Load(%#q) expected a not exist error, got %v", path, err)
+	}
+
+	state := sampleState()
+	if err := checkpoint.Save(path, state); err != nil {
+		t.Fatalf("checkpoint.Save(%#q) got error %v", path, err)
+	}
+
+	got, err := checkpoint.Load(path)
+	if err != nil {
+		t.Fatalf("checkpoint.Load(%#q) got error %v", path, err)
+	}
+
+	if !reflect.DeepEqual(state, got) {
+		t.Errorf("checkpoint.Load(%#q) expected %+v, got %+v", path, state, got)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("checkpoint.Save(%#q) expected temporary files to be cleaned up, got %v files", path, len(files))
+	}
+}
+
+func TestSnapshotsAndRestoresFollowGraph(t *testing.T) {
+	registryCh := client.NewRegistry()
+	defer close(registryCh)
+
+	state := sampleState()
+
+	registryCh <- checkpoint.RestoreFunc(state)
+
+	stateCh := make(chan *checkpoint.State, 1)
+
+	registryCh <- checkpoint.SnapshotFunc(state.Index, stateCh)
+
+	got := <-stateCh
+
+	// Users without followers aren't recorded
+	delete(state.Followers, 2)
+
+	if !reflect.DeepEqual(state, got) {
+		t.Errorf("checkpoint.SnapshotFunc(checkpoint.RestoreFunc(%+v)) got %+v", state, got)
+	}
+}
@@ -11,3 +11,9 @@ type Interface io.ReadWriteCloser
 type Payloader interface {
 	Payload() []byte
 }
+
+// Sequenced is a Payloader that carries the sequence number of its event.
+type Sequenced interface {
+	Payloader
+	Sequence() uint64
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+var (
+	IncorrectHandshakeError = errors.New("handshake is formatted incorrectly")
+
+	resumeKeyword = []byte("resume")
+)
+
+// Handshake is the identification line sent by a user client, e.g.
+// `2932\r\n` or `2932 resume 184467\r\n` for resuming after the
+// notification numbered 184467.
+type Handshake struct {
+	UID UID
+
+	// Whether the client requested the notifications it missed.
+	Resume bool
+
+	// Sequence number of the last notification the client has seen.
+	Since uint64
+}
+
+// ParseHandshake parses an identification line without the line terminator.
+// In StringUIDs mode the user ID is referenced until it's released with
+// ReleaseUID, e.g. by DisconnectFunc once the client disconnects.
+func ParseHandshake(buf []byte) (Handshake, error) {
+	fields := bytes.Fields(buf)
+
+	switch {
+	case len(fields) == 1:
+	case len(fields) == 3 && bytes.Equal(fields[1], resumeKeyword):
+	default:
+		return Handshake{}, IncorrectHandshakeError
+	}
+
+	var h Handshake
+
+	// Parses the sequence number first, so that invalid handshakes don't reference the ID.
+	if len(fields) == 3 {
+		seq, err := strconv.ParseUint(string(fields[2]), 10, 64)
+		if err != nil {
+			return Handshake{}, IncorrectHandshakeError
+		}
+
+		h.Resume, h.Since = true, seq
+	}
+
+	uid, err := parseUID(fields[0], true)
+	if err != nil {
+		return Handshake{}, err
+	}
+
+	h.UID = uid
+
+	return h, nil
+}
@@ -0,0 +1,163 @@
+package client_test
+
+import (
+	"testing"
+
+	"."
+)
+
+func TestParsesHandshakes(t *testing.T) {
+	tests := []struct {
+		line      string
+		handshake client.Handshake
+		err       error
+	}{
+		{line: "2932", handshake: client.Handshake{UID: 2932}},
+		{line: "2932 resume 184467", handshake: client.Handshake{UID: 2932, Resume: true, Since: 184467}},
+		{line: "2932 resume 0", handshake: client.Handshake{UID: 2932, Resume: true}},
+		{line: "", err: client.IncorrectHandshakeError},
+		{line: "2932 resume", err: client.IncorrectHandshakeError},
+		{line: "2932 rewind 184467", err: client.IncorrectHandshakeError},
+		{line: "2932 resume -1", err: client.IncorrectHandshakeError},
+		{line: "2932 resume 1 2", err: client.IncorrectHandshakeError},
+	}
+
+	for _, testCase := range tests {
+		h, err := client.ParseHandshake([]byte(testCase.line))
+		if err != testCase.err {
+			t.Errorf("client.ParseHandshake(%#q) expected error %v, got %v", testCase.line, testCase.err, err)
+		}
+
+		if h != testCase.handshake {
+			t.Errorf("client.ParseHandshake(%#q) expected %+v, got %+v", testCase.line, testCase.handshake, h)
+		}
+	}
+}
+
+func TestRejectsMalformedUIDs(t *testing.T) {
+	for _, line := range []string{"abc", "-1", "2932x resume 1"} {
+		if _, err := client.ParseHandshake([]byte(line)); err == nil {
+			t.Errorf("client.ParseHandshake(%#q) expected an error, got none", line)
+		}
+	}
+}
+
+func TestParsesStringUIDs(t *testing.T) {
+	defer func(mode client.UIDMode, length int) {
+		client.Mode, client.MaxUIDLength = mode, length
+	}(client.Mode, client.MaxUIDLength)
+
+	client.Mode, client.MaxUIDLength = client.StringUIDs, 8
+
+	h, err := client.ParseHandshake([]byte("alice resume 42"))
+	if err != nil {
+		t.Fatalf("client.ParseHandshake(%#q) got error %v", "alice resume 42", err)
+	}
+
+	if expected, got := "alice", h.UID.String(); expected != got {
+		t.Errorf("client.ParseHandshake(%#q) expected UID %#q, got %#q", "alice resume 42", expected, got)
+	}
+
+	if uid, _ := client.ParseUID([]byte("alice")); uid != h.UID {
+		t.Errorf("client.ParseUID(%#q) expected the same UID %v, got %v", "alice", h.UID, uid)
+	}
+
+	if uid, _ := client.ParseUID([]byte("bob")); uid == h.UID {
+		t.Errorf("client.ParseUID(%#q) expected a different UID than %#q", "bob", "alice")
+	}
+
+	tests := []struct {
+		id  string
+		err error
+	}{
+		{"çağrı", nil},
+		{"", client.IncorrectUIDError},
+		{"a|b", client.IncorrectUIDError},
+		{"a\tb", client.IncorrectUIDError},
+		{"\xff", client.IncorrectUIDError},
+		{"too-long-id", client.UIDTooLongError},
+	}
+
+	for _, testCase := range tests {
+		if _, err := client.ParseUID([]byte(testCase.id)); err != testCase.err {
+			t.Errorf("client.ParseUID(%#q) expected error %v, got %v", testCase.id, testCase.err, err)
+		}
+	}
+}
+
+func TestLimitsStringUIDs(t *testing.T) {
+	defer func(mode client.UIDMode, limit int) {
+		client.Mode, client.MaxStringUIDs = mode, limit
+	}(client.Mode, client.MaxStringUIDs)
+
+	client.Mode = client.StringUIDs
+
+	known, err := client.ParseUID([]byte("alice"))
+	if err != nil {
+		t.Fatalf("client.ParseUID(%#q) got error %v", "alice", err)
+	}
+
+	client.MaxStringUIDs = 1
+
+	if uid, err := client.ParseUID([]byte("alice")); err != nil || uid != known {
+		t.Errorf("client.ParseUID(%#q) over the limit expected known UID %v, got %v with error %v", "alice", known, uid, err)
+	}
+
+	if _, err := client.ParseUID([]byte("mallory")); err != client.TooManyUIDsError {
+		t.Errorf("client.ParseUID(%#q) over the limit expected error %v, got %v", "mallory", client.TooManyUIDsError, err)
+	}
+}
+
+func TestReleasesHandshakeUIDs(t *testing.T) {
+	defer func(mode client.UIDMode, limit int) {
+		client.Mode, client.MaxStringUIDs = mode, limit
+	}(client.Mode, client.MaxStringUIDs)
+
+	client.Mode = client.StringUIDs
+
+	// Finds the limit that leaves room for a single new user ID.
+	for client.MaxStringUIDs = 1; ; client.MaxStringUIDs++ {
+		if h, err := client.ParseHandshake([]byte("probe")); err == nil {
+			client.ReleaseUID(h.UID)
+			break
+		}
+	}
+
+	junk, err := client.ParseHandshake([]byte("junk"))
+	if err != nil {
+		t.Fatalf("client.ParseHandshake(%#q) got error %v", "junk", err)
+	}
+
+	if _, err := client.ParseHandshake([]byte("newcomer")); err != client.TooManyUIDsError {
+		t.Errorf("client.ParseHandshake(%#q) over the limit expected error %v, got %v", "newcomer", client.TooManyUIDsError, err)
+	}
+
+	if !client.ReleaseUID(junk.UID) {
+		t.Errorf("client.ReleaseUID(%v) expected the ID of the disconnected client to be freed", junk.UID)
+	}
+
+	newcomer, err := client.ParseHandshake([]byte("newcomer"))
+	if err != nil {
+		t.Fatalf("client.ParseHandshake(%#q) after a release got error %v", "newcomer", err)
+	}
+
+	client.ReleaseUID(newcomer.UID)
+
+	carol, err := client.ParseHandshake([]byte("carol"))
+	if err != nil {
+		t.Fatalf("client.ParseHandshake(%#q) got error %v", "carol", err)
+	}
+
+	// An event names the user, so the ID is kept after the client disconnects.
+	if uid, err := client.ParseUID([]byte("carol")); err != nil || uid != carol.UID {
+		t.Errorf("client.ParseUID(%#q) expected UID %v, got %v with error %v", "carol", carol.UID, uid, err)
+	}
+
+	if client.ReleaseUID(carol.UID) {
+		t.Errorf("client.ReleaseUID(%v) expected the ID named by an event to be kept", carol.UID)
+	}
+
+	if expected, got := "carol", carol.UID.String(); expected != got {
+		t.Errorf("client.UID(%v).String() expected %#q, got %#q", carol.UID, expected, got)
+	}
+}
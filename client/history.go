@@ -0,0 +1,89 @@
+package client
+
+import (
+	"time"
+)
+
+var (
+	// HistorySize is the number of recent notifications that are kept for each
+	// user, so that reconnecting clients can resume. Zero disables the history.
+	HistorySize = 1024
+
+	// HistoryMaxAge is how long the history of a user is kept after the user
+	// becomes inactive. Zero means that histories are kept forever.
+	HistoryMaxAge = time.Hour
+)
+
+// history is a ring buffer of the recent notifications of a user.
+// It grows up to the given size as notifications are added.
+type history struct {
+	entries []Sequenced
+	size    int
+	next    int
+
+	// Whether older entries have been overwritten.
+	hasEvicted bool
+}
+
+func newHistory(size int) *history {
+	return &history{
+		size: size,
+	}
+}
+
+// add records the given notification, evicting the oldest one if the history is full.
+func (h *history) add(p Sequenced) {
+	if len(h.entries) < h.size {
+		h.entries = append(h.entries, p)
+		return
+	}
+
+	h.entries[h.next] = p
+	h.next = (h.next + 1) % len(h.entries)
+	h.hasEvicted = true
+}
+
+// since returns the recorded notifications with sequence numbers greater
+// than the given one in order and whether the history reaches back to it.
+func (h *history) since(seq uint64) ([]Sequenced, bool) {
+	if h == nil || len(h.entries) == 0 {
+		return nil, true
+	}
+
+	var missed []Sequenced
+	for i := range h.entries {
+		p := h.entries[(h.next+i)%len(h.entries)]
+
+		if p.Sequence() > seq {
+			missed = append(missed, p)
+		}
+	}
+
+	isComplete := !h.hasEvicted || len(missed) < len(h.entries)
+
+	return missed, isComplete
+}
+
+// expireHistories releases the histories of the users that have been
+// inactive for longer than maxAge and stops recording them until the users
+// connect again. It's called periodically by the registry, so inactivity
+// is measured with the precision of its interval.
+func expireHistories(clients Registry, maxAge time.Duration, now time.Time) {
+	for _, session := range clients {
+		if session == nil || !session.isRecording {
+			continue
+		}
+
+		switch {
+		case session.IsActive():
+			session.inactiveSince = time.Time{}
+		case session.inactiveSince.IsZero():
+			session.inactiveSince = now
+		case now.Sub(session.inactiveSince) >= maxAge:
+			session.history, session.inactiveSince = nil, time.Time{}
+			session.isRecording = false
+
+			counters.Add("history.expired", 1)
+		}
+	}
+}
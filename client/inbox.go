@@ -0,0 +1,62 @@
+package client
+
+import (
+	"expvar"
+	"time"
+)
+
+var (
+	// InboxSize is the maximum number of notifications that are kept for
+	// an inactive user until it registers. Zero disables the inbox.
+	InboxSize = 256
+
+	// InboxMaxAge is how long a notification is kept for an inactive user.
+	// Zero means that notifications don't expire.
+	InboxMaxAge = time.Hour
+)
+
+// counters keeps the client statistics, e.g. number of dropped notifications.
+var counters = expvar.NewMap("client")
+
+type letter struct {
+	p          Payloader
+	receivedAt time.Time
+}
+
+// inbox is a bounded queue of notifications for an inactive user.
+// Oldest notifications are dropped when it is full.
+type inbox struct {
+	letters []letter
+}
+
+// push stores the given notification.
+func (in *inbox) push(p Payloader) {
+	if len(in.letters) >= InboxSize {
+		in.letters = in.letters[1:]
+
+		counters.Add("inbox.dropped", 1)
+	}
+
+	in.letters = append(in.letters, letter{p, time.Now()})
+}
+
+// drain empties the inbox and returns the notifications that haven't expired in order.
+func (in *inbox) drain() []Payloader {
+	if in == nil {
+		return nil
+	}
+
+	var ps []Payloader
+	for _, l := range in.letters {
+		if InboxMaxAge > 0 && time.Since(l.receivedAt) > InboxMaxAge {
+			counters.Add("inbox.expired", 1)
+			continue
+		}
+
+		ps = append(ps, l.p)
+	}
+
+	in.letters = nil
+
+	return ps
+}
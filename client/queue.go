@@ -0,0 +1,160 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+
+	"../log"
+)
+
+// SlowConsumerPolicy denotes what to do with a notification when the
+// send queue of a user client is full.
+type SlowConsumerPolicy int
+
+const (
+	// DropNewestPolicy drops the notification that doesn't fit.
+	DropNewestPolicy SlowConsumerPolicy = iota
+
+	// DropOldestPolicy drops the oldest queued notification to make room.
+	DropOldestPolicy
+
+	// DisconnectPolicy closes the session, so that the client reconnects
+	// and resumes from the history.
+	DisconnectPolicy
+)
+
+var (
+	// QueueSize is the maximum number of notifications waiting to be
+	// written to a user client. Zero means unbounded.
+	QueueSize = 1024
+
+	// SlowConsumer decides what happens when the send queue of a user client is full.
+	SlowConsumer = DisconnectPolicy
+)
+
+// queue decouples a session from its user client, so that the registry never
+// blocks on a slow client. Notifications are forwarded to the channel of the
+// client by a dedicated goroutine.
+type queue struct {
+	// Captured by newQueue, so that every queue keeps its own settings.
+	size         int
+	slowConsumer SlowConsumerPolicy
+
+	mu       sync.Mutex
+	payloads []Payloader
+	isClosed bool
+
+	// signalCh wakes the pump up when a notification is pushed or the queue is closed.
+	signalCh chan struct{}
+
+	// quitCh stops the pump without flushing the queue.
+	quitCh chan struct{}
+}
+
+// newQueue creates a queue that forwards notifications to the given channel.
+// The channel is closed once the queue is closed.
+func newQueue(payloadCh chan<- Payloader) *queue {
+	q := &queue{
+		size:         QueueSize,
+		slowConsumer: SlowConsumer,
+		signalCh:     make(chan struct{}, 1),
+		quitCh:       make(chan struct{}),
+	}
+
+	go q.pump(payloadCh)
+
+	return q
+}
+
+// push enqueues the given notification and reports whether the
+// session should be disconnected according to the SlowConsumer policy.
+func (q *queue) push(p Payloader) (disconnect bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.size > 0 && len(q.payloads) >= q.size {
+		switch q.slowConsumer {
+		case DropNewestPolicy:
+			counters.Add("queue.dropped newest", 1)
+			return false
+		case DropOldestPolicy:
+			q.payloads = q.payloads[1:]
+
+			counters.Add("queue.dropped oldest", 1)
+		case DisconnectPolicy:
+			counters.Add("queue.disconnected", 1)
+			return true
+		}
+	}
+
+	q.payloads = append(q.payloads, p)
+	q.signal()
+
+	return false
+}
+
+// signal wakes the pump up without blocking.
+func (q *queue) signal() {
+	select {
+	case q.signalCh <- struct{}{}:
+	default:
+	}
+}
+
+// close makes the pump forward the remaining notifications and close the channel.
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.isClosed = true
+	q.signal()
+}
+
+// abort makes the pump close the channel without forwarding the remaining notifications.
+func (q *queue) abort() {
+	q.close()
+
+	close(q.quitCh)
+}
+
+// pump forwards the queued notifications to the given channel in order.
+func (q *queue) pump(payloadCh chan<- Payloader) {
+	// Recovers when the channel is shared with another session that closed it already.
+	defer func() {
+		if err := recover(); err != nil {
+			log.Debug(fmt.Sprintf("client.queue: channel panic recovered from %v", err))
+		}
+	}()
+
+	defer close(payloadCh)
+
+	for {
+		q.mu.Lock()
+		if len(q.payloads) == 0 {
+			isClosed := q.isClosed
+			q.mu.Unlock()
+
+			if isClosed {
+				return
+			}
+
+			select {
+			case <-q.signalCh:
+			case <-q.quitCh:
+				return
+			}
+
+			continue
+		}
+
+		p := q.payloads[0]
+		q.payloads[0], q.payloads = nil, q.payloads[1:]
+		q.mu.Unlock()
+
+		select {
+		case payloadCh <- p:
+		case <-q.quitCh:
+			return
+		}
+	}
+}
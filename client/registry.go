@@ -2,59 +2,130 @@ package client
 
 import (
 	"fmt"
-	"os"
+	"time"
 
 	"../log"
 )
 
 // Session contains necessary information
 // to communicate with users and their followers.
+// A user may be connected through multiple devices at once,
+// every notification is sent to each of them.
 type Session struct {
-	isClosed bool
+	Followers UIDSet
 
-	Chan chan<- Payloader
+	// devices contains the send queue of each connection of the user.
+	devices map[chan<- Payloader]*queue
 
-	Followers UIDSet
+	history *history
+	inbox   *inbox
+
+	// isRecording tells whether notifications are recorded in the history,
+	// i.e. a device has been attached and the history hasn't expired since.
+	isRecording bool
+
+	// inactiveSince is when the session was first seen inactive with a history.
+	inactiveSince time.Time
 }
 
 // IsActive tells whether the given session is activated.
-// The meaning of activation is that, it has an open communication
-// channel to communicate with the user
+// The meaning of activation is that, it has at least one open
+// communication channel to communicate with the user
 func (s *Session) IsActive() bool {
-	return s.Chan != nil && !s.isClosed
+	return len(s.devices) > 0
 }
 
-// Send sends a given payload to the owner of the session.
-// If the connection has been closed, it returns an error.
+// Send sends a given payload to every device of the owner of the session.
+// Payloads with sequence numbers are recorded in the history of the
+// session even if it is inactive, so that the user can resume later on.
+// Users that have never connected or whose history has expired have no history.
 func (s *Session) Send(p Payloader) error {
+	if p, ok := p.(Sequenced); ok && HistorySize > 0 && s.isRecording {
+		if s.history == nil {
+			s.history = newHistory(HistorySize)
+		}
+
+		s.history.add(p)
+	}
+
+	return s.deliver(p)
+}
+
+// SendOrStore sends a given payload like Send, but if the session is
+// inactive the payload is kept in the inbox of the session and delivered
+// in order once the user registers.
+func (s *Session) SendOrStore(p Payloader) error {
+	if s.IsActive() || InboxSize <= 0 {
+		return s.Send(p)
+	}
+
+	if s.inbox == nil {
+		s.inbox = new(inbox)
+	}
+
+	s.inbox.push(p)
+
+	return s.Send(p)
+}
+
+// deliver queues a given payload for every device of the owner of the session without recording it.
+func (s *Session) deliver(p Payloader) error {
 	if !s.IsActive() {
 		log.Debug("client.Session: client is inactive")
 		return nil
 	}
 
-	// Recovers when channel is prematurely closed due to most likely connection errors.
-	defer func() {
-		if err := recover(); err != nil {
-			s.isClosed = true
-			log.Debug(fmt.Sprintf("channel.Send panic recovered from %v", err))
-		}
-	}()
-
-	s.Chan <- p
+	for payloadCh, q := range s.devices {
+		s.deliverTo(payloadCh, q, p)
+	}
 
 	return nil
 }
 
-// Close closes communication channels of a session.
-func (s *Session) Close() error {
-	if !s.IsActive() {
-		return nil
+// deliverTo queues a given payload for a single device.
+// If the queue is full, the SlowConsumer policy is applied.
+func (s *Session) deliverTo(payloadCh chan<- Payloader, q *queue, p Payloader) {
+	if q.push(p) {
+		log.Info("client.Session: client is too slow to keep up, disconnecting")
+
+		q.abort()
+		delete(s.devices, payloadCh)
+	}
+}
+
+// attach adds a device to the session and returns its send queue.
+// Attaching a device more than once has no effect.
+func (s *Session) attach(payloadCh chan<- Payloader) *queue {
+	if q, ok := s.devices[payloadCh]; ok {
+		return q
+	}
+
+	if s.devices == nil {
+		s.devices = make(map[chan<- Payloader]*queue)
 	}
 
-	// Checks whether the channel is closed or not in a non-blocking manner.
-	s.isClosed = true
+	q := newQueue(payloadCh)
+	s.devices[payloadCh] = q
+
+	s.inactiveSince, s.isRecording = time.Time{}, true
+
+	return q
+}
 
-	close(s.Chan)
+// detach closes the channel of a single device once its queued notifications are sent.
+func (s *Session) detach(payloadCh chan<- Payloader) {
+	if q, ok := s.devices[payloadCh]; ok {
+		q.close()
+		delete(s.devices, payloadCh)
+	}
+}
+
+// Close closes communication channels of every device of a session
+// once the queued notifications are sent.
+func (s *Session) Close() error {
+	for payloadCh := range s.devices {
+		s.detach(payloadCh)
+	}
 
 	return nil
 }
@@ -83,19 +154,91 @@ type RegistryFunc func(Registry) error
 
 // RegisterFunc creates a RegistryFunc that registers the given client to the
 // Registry when invoked by the Registry itself.
+// The client is added as another device if the user is already connected.
+// Notifications kept in the inbox of the user are delivered right away.
 func RegisterFunc(uid UID, payloadCh chan<- Payloader) RegistryFunc {
 	return func(clients Registry) error {
-		// For preserving the follower list.
-		if _, ok := clients[uid]; ok {
-			clients[uid] = &Session{
-				Chan:      payloadCh,
-				Followers: clients[uid].Followers,
-			}
-		} else {
-			clients[uid] = &Session{
-				Chan:      payloadCh,
-				Followers: make(UIDSet),
+		session, q := register(clients, uid, payloadCh)
+		if q == nil {
+			return nil
+		}
+
+		for _, p := range session.inbox.drain() {
+			session.deliverTo(payloadCh, q, p)
+		}
+
+		return nil
+	}
+}
+
+// ResumeFunc creates a RegistryFunc that registers the given client like
+// RegisterFunc and replays the notifications with sequence numbers greater
+// than seq from the history and the inbox of the user before any further notifications.
+// Only the resuming device receives the replayed notifications.
+func ResumeFunc(uid UID, payloadCh chan<- Payloader, seq uint64) RegistryFunc {
+	return func(clients Registry) error {
+		session, q := register(clients, uid, payloadCh)
+		if q == nil {
+			return nil
+		}
+
+		missed, isComplete := session.history.since(seq)
+		if !isComplete {
+			log.Info(fmt.Sprintf("client.ResumeFunc: history of user %v doesn't reach back to %v, some notifications are lost", uid, seq))
+		}
+
+		for _, p := range missed {
+			session.deliverTo(payloadCh, q, p)
+
+			seq = p.Sequence()
+		}
+
+		// Inbox might contain notifications that have just been replayed.
+		for _, p := range session.inbox.drain() {
+			if p, ok := p.(Sequenced); ok && p.Sequence() <= seq {
+				continue
 			}
+
+			session.deliverTo(payloadCh, q, p)
+		}
+
+		return nil
+	}
+}
+
+// register attaches the given channel to the session of the given user
+// and returns the session along with the send queue of the channel.
+// The follower list and the history of an existing session are preserved.
+func register(clients Registry, uid UID, payloadCh chan<- Payloader) (*Session, *queue) {
+	session, ok := clients[uid]
+	if !ok || session == nil {
+		session = &Session{
+			Followers: make(UIDSet),
+		}
+
+		clients[uid] = session
+	}
+
+	if payloadCh == nil {
+		return session, nil
+	}
+
+	return session, session.attach(payloadCh)
+}
+
+// DisconnectFunc returns a RegistryFunc that detaches a single device of
+// a user when invoked. The session is kept along with its followers,
+// so it becomes inactive once its last device disconnects.
+// It also releases the user ID referenced by the handshake of the device,
+// the session is removed if the ID is freed, since it can be reassigned.
+func DisconnectFunc(uid UID, payloadCh chan<- Payloader) RegistryFunc {
+	return func(clients Registry) error {
+		if session, ok := clients[uid]; ok && session != nil {
+			session.detach(payloadCh)
+		}
+
+		if ReleaseUID(uid) {
+			delete(clients, uid)
 		}
 
 		return nil
@@ -114,28 +257,44 @@ func UnregisterFunc(uid UID) RegistryFunc {
 
 // NewRegistry creates a new client.Registry and returns
 // a RegistryFunc channel for communication purposes.
+// Closing the channel terminates every session in the registry.
+// Histories of inactive users are released after HistoryMaxAge.
 func NewRegistry() chan<- RegistryFunc {
 	funcCh := make(chan RegistryFunc)
 
 	clientRegistry := make(Registry)
 
+	maxAge := HistoryMaxAge
+
 	go func(funcCh <-chan RegistryFunc) {
 		defer func() {
 			clientRegistry.tearDown()
 
 			log.Info("Every notification has been sent.")
-
-			os.Exit(0)
 		}()
 
-		for use := range funcCh {
-			err := use(clientRegistry)
-			if err != nil {
-				log.Debug(fmt.Sprintf("error while executing a client.RegistryFunc %#v", err))
-				continue
-			}
+		var tickCh <-chan time.Time
+		if maxAge > 0 {
+			ticker := time.NewTicker(maxAge / 4)
+			defer ticker.Stop()
+
+			tickCh = ticker.C
 		}
 
+		for {
+			select {
+			case use, ok := <-funcCh:
+				if !ok {
+					return
+				}
+
+				if err := use(clientRegistry); err != nil {
+					log.Debug(fmt.Sprintf("error while executing a client.RegistryFunc %#v", err))
+				}
+			case now := <-tickCh:
+				expireHistories(clientRegistry, maxAge, now)
+			}
+		}
 	}(funcCh)
 
 	return funcCh
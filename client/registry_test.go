@@ -1,9 +1,12 @@
 package client_test
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"."
+	"../testutil"
 )
 
 func TestRegistersClientsToRegistry(t *testing.T) {
@@ -68,3 +71,365 @@ func TestUnregistersClientsToRegistry(t *testing.T) {
 		t.Errorf("client.UnregisterFunc => expected %v to be unregistered, but it wasn't", uid)
 	}
 }
+
+type notification uint64
+
+func (n notification) Payload() []byte {
+	return []byte(fmt.Sprintf("%v|B\n", uint64(n)))
+}
+
+func (n notification) Sequence() uint64 {
+	return uint64(n)
+}
+
+func TestResumesFromHistory(t *testing.T) {
+	defer func(size int) {
+		client.HistorySize = size
+	}(client.HistorySize)
+
+	client.HistorySize = 3
+
+	uid := client.UID(92)
+
+	registryCh := client.NewRegistry()
+	defer close(registryCh)
+
+	payloadCh := make(chan client.Payloader, 4)
+
+	registryCh <- client.RegisterFunc(uid, payloadCh)
+
+	// The user disconnects after receiving the notification numbered 1.
+	registryCh <- func(r client.Registry) error {
+		r[uid].Send(notification(1))
+
+		r[uid].Close()
+
+		for n := 2; n <= 5; n++ {
+			r[uid].Send(notification(n))
+		}
+
+		return nil
+	}
+
+	if expected, got := "1|B\n", string((<-payloadCh).Payload()); expected != got {
+		t.Fatalf("client.Session.Send expected %#q, got %#q", expected, got)
+	}
+
+	resumedCh := make(chan client.Payloader, 4)
+
+	registryCh <- client.ResumeFunc(uid, resumedCh, 3)
+
+	registryCh <- func(r client.Registry) error {
+		r[uid].Send(notification(6))
+
+		return nil
+	}
+
+	for _, expected := range []string{"4|B\n", "5|B\n", "6|B\n"} {
+		if got := string((<-resumedCh).Payload()); expected != got {
+			t.Errorf("client.ResumeFunc => expected missed notifications in order, should have got %#q, but received %#q", expected, got)
+		}
+	}
+}
+
+func TestKeepsNotificationsForInactiveUsers(t *testing.T) {
+	defer func(size int, maxAge time.Duration) {
+		client.InboxSize, client.InboxMaxAge = size, maxAge
+	}(client.InboxSize, client.InboxMaxAge)
+
+	client.InboxSize = 2
+	client.InboxMaxAge = time.Hour
+
+	uid := client.UID(92)
+
+	registryCh := client.NewRegistry()
+	defer close(registryCh)
+
+	registryCh <- func(r client.Registry) error {
+		r[uid] = &client.Session{
+			Followers: make(client.UIDSet),
+		}
+
+		for n := 1; n <= 3; n++ {
+			r[uid].SendOrStore(notification(n))
+		}
+
+		return nil
+	}
+
+	payloadCh := make(chan client.Payloader, 3)
+
+	registryCh <- client.RegisterFunc(uid, payloadCh)
+
+	for _, expected := range []string{"2|B\n", "3|B\n"} {
+		if got := string((<-payloadCh).Payload()); expected != got {
+			t.Errorf("client.RegisterFunc => expected stored notifications in order, should have got %#q, but received %#q", expected, got)
+		}
+	}
+
+	select {
+	case p := <-payloadCh:
+		t.Errorf("client.RegisterFunc => expected oldest notification to be dropped, but received %#q", string(p.Payload()))
+	default:
+	}
+}
+
+func TestExpiresStoredNotifications(t *testing.T) {
+	defer func(maxAge time.Duration) {
+		client.InboxMaxAge = maxAge
+	}(client.InboxMaxAge)
+
+	client.InboxMaxAge = time.Nanosecond
+
+	uid := client.UID(92)
+
+	registryCh := client.NewRegistry()
+	defer close(registryCh)
+
+	registryCh <- func(r client.Registry) error {
+		r[uid] = &client.Session{
+			Followers: make(client.UIDSet),
+		}
+
+		r[uid].SendOrStore(notification(1))
+
+		return nil
+	}
+
+	time.Sleep(time.Millisecond)
+
+	payloadCh := make(chan client.Payloader, 1)
+
+	registryCh <- client.RegisterFunc(uid, payloadCh)
+
+	// Registry handles the closures in order.
+	doneCh := make(chan struct{})
+	registryCh <- func(client.Registry) error {
+		close(doneCh)
+
+		return nil
+	}
+
+	<-doneCh
+
+	select {
+	case p := <-payloadCh:
+		t.Errorf("client.RegisterFunc => expected stored notification to expire, but received %#q", string(p.Payload()))
+	default:
+	}
+}
+
+func TestAppliesSlowConsumerPolicy(t *testing.T) {
+	defer func(size int, policy client.SlowConsumerPolicy) {
+		client.QueueSize, client.SlowConsumer = size, policy
+	}(client.QueueSize, client.SlowConsumer)
+
+	client.QueueSize = 2
+
+	tests := []struct {
+		policy   client.SlowConsumerPolicy
+		expected []string
+		counter  string
+	}{
+		{client.DropNewestPolicy, []string{"1|B\n", "2|B\n", "3|B\n"}, "queue.dropped newest"},
+		{client.DropOldestPolicy, []string{"1|B\n", "4|B\n", "5|B\n"}, "queue.dropped oldest"},
+		{client.DisconnectPolicy, nil, "queue.disconnected"},
+	}
+
+	for _, testCase := range tests {
+		client.SlowConsumer = testCase.policy
+
+		uid := client.UID(92)
+
+		registryCh := client.NewRegistry()
+
+		payloadCh := make(chan client.Payloader)
+
+		registryCh <- client.RegisterFunc(uid, payloadCh)
+
+		registryCh <- func(r client.Registry) error {
+			r[uid].Send(notification(1))
+
+			return nil
+		}
+
+		// The client is stuck with the first notification while the rest arrive.
+		time.Sleep(20 * time.Millisecond)
+
+		before := counter(testCase.counter)
+
+		isActiveCh := make(chan bool)
+		registryCh <- func(r client.Registry) error {
+			for n := 2; n <= 5; n++ {
+				r[uid].Send(notification(n))
+			}
+
+			isActiveCh <- r[uid].IsActive()
+
+			return nil
+		}
+
+		if expected, got := testCase.policy != client.DisconnectPolicy, <-isActiveCh; expected != got {
+			t.Errorf("client.Session.Send with policy %v expected session.IsActive() to be %v, got %v", testCase.policy, expected, got)
+		}
+
+		var got []string
+		for p := range payloadCh {
+			got = append(got, string(p.Payload()))
+
+			if len(got) == len(testCase.expected) {
+				close(registryCh)
+			}
+		}
+
+		if fmt.Sprint(testCase.expected) != fmt.Sprint(got) {
+			t.Errorf("client.Session.Send with policy %v expected notifications %#q, got %#q", testCase.policy, testCase.expected, got)
+		}
+
+		if testCase.policy == client.DisconnectPolicy {
+			close(registryCh)
+		}
+
+		if counter(testCase.counter) <= before {
+			t.Errorf("client.Session.Send with policy %v expected counter %q to increase", testCase.policy, testCase.counter)
+		}
+	}
+}
+
+func counter(name string) int64 {
+	return testutil.Counter("client", name)
+}
+
+func TestSendsToEveryDevice(t *testing.T) {
+	uid := client.UID(92)
+
+	registryCh := client.NewRegistry()
+	defer close(registryCh)
+
+	phoneCh, laptopCh := make(chan client.Payloader, 2), make(chan client.Payloader, 2)
+
+	registryCh <- client.RegisterFunc(uid, phoneCh)
+	registryCh <- client.RegisterFunc(uid, laptopCh)
+
+	registryCh <- func(r client.Registry) error {
+		r[uid].Followers.Add(15)
+		r[uid].Send(notification(1))
+
+		return nil
+	}
+
+	for _, payloadCh := range []chan client.Payloader{phoneCh, laptopCh} {
+		if expected, got := "1|B\n", string((<-payloadCh).Payload()); expected != got {
+			t.Errorf("client.Session.Send expected every device to receive %#q, got %#q", expected, got)
+		}
+	}
+
+	registryCh <- client.DisconnectFunc(uid, phoneCh)
+
+	registryCh <- func(r client.Registry) error {
+		r[uid].Send(notification(2))
+
+		return nil
+	}
+
+	if expected, got := "2|B\n", string((<-laptopCh).Payload()); expected != got {
+		t.Errorf("client.Session.Send expected remaining device to receive %#q, got %#q", expected, got)
+	}
+
+	if p, ok := <-phoneCh; ok {
+		t.Errorf("client.DisconnectFunc expected the device channel to be closed, but received %#q", string(p.Payload()))
+	}
+
+	registryCh <- client.DisconnectFunc(uid, laptopCh)
+
+	sessionCh := make(chan client.Session)
+	registryCh <- func(r client.Registry) error {
+		sessionCh <- *r[uid]
+
+		return nil
+	}
+
+	session := <-sessionCh
+
+	if session.IsActive() {
+		t.Errorf("client.DisconnectFunc expected the session to be inactive once every device disconnects")
+	}
+
+	if !session.Followers.Contains(15) {
+		t.Errorf("client.DisconnectFunc expected the followers to be kept, got %v", session.Followers)
+	}
+}
+
+func TestExpiresHistoryOfInactiveUsers(t *testing.T) {
+	defer func(maxAge time.Duration) {
+		client.HistoryMaxAge = maxAge
+	}(client.HistoryMaxAge)
+
+	client.HistoryMaxAge = time.Millisecond
+
+	uid := client.UID(93)
+
+	expired := counter("history.expired")
+
+	registryCh := client.NewRegistry()
+	defer close(registryCh)
+
+	deviceCh := make(chan client.Payloader, 1)
+
+	registryCh <- client.RegisterFunc(uid, deviceCh)
+	registryCh <- client.DisconnectFunc(uid, deviceCh)
+
+	registryCh <- func(r client.Registry) error {
+		return r[uid].Send(notification(1))
+	}
+
+	for deadline := time.Now().Add(time.Second); counter("history.expired") == expired; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("client.Registry => expected the history of an inactive user to expire")
+		}
+	}
+
+	// Followed users keep receiving notifications while their history is expired.
+	registryCh <- func(r client.Registry) error {
+		return r[uid].Send(notification(2))
+	}
+
+	resumedCh := make(chan client.Payloader, 2)
+
+	registryCh <- client.ResumeFunc(uid, resumedCh, 0)
+
+	registryCh <- func(r client.Registry) error {
+		return r[uid].Send(notification(3))
+	}
+
+	if expected, got := "3|B\n", string((<-resumedCh).Payload()); expected != got {
+		t.Errorf("client.ResumeFunc => expected the expired history not to be recorded again, should have got %#q, but received %#q", expected, got)
+	}
+}
+
+func TestRecordsHistoryOfConnectedUsersOnly(t *testing.T) {
+	uid := client.UID(94)
+
+	registryCh := client.NewRegistry()
+	defer close(registryCh)
+
+	registryCh <- func(r client.Registry) error {
+		r[uid] = &client.Session{
+			Followers: make(client.UIDSet),
+		}
+
+		return r[uid].Send(notification(1))
+	}
+
+	resumedCh := make(chan client.Payloader, 2)
+
+	registryCh <- client.ResumeFunc(uid, resumedCh, 0)
+
+	registryCh <- func(r client.Registry) error {
+		return r[uid].Send(notification(2))
+	}
+
+	if expected, got := "2|B\n", string((<-resumedCh).Payload()); expected != got {
+		t.Errorf("client.ResumeFunc => expected users that have never connected to have no history, should have got %#q, but received %#q", expected, got)
+	}
+}
@@ -1,16 +1,206 @@
 package client
 
-import "strconv"
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
 
-// UID is a user ID number limit that is currently sufficient.
-// TODO(tmrts): Use big.Int if necessary later on.
+// UID is a user ID. In NumericUIDs mode it is the number itself,
+// in StringUIDs mode it is a handle for an interned string ID.
 type UID uint64
 
+// UIDMode denotes how user IDs are written on the wire.
+type UIDMode int
+
+const (
+	// NumericUIDs mode accepts unsigned 64-bit decimal numbers.
+	NumericUIDs UIDMode = iota
+
+	// StringUIDs mode accepts opaque UTF-8 strings up to MaxUIDLength bytes
+	// that don't contain whitespace, control characters or a '|' separator.
+	StringUIDs
+)
+
+var (
+	// Mode is the user ID mode, it should be set before any UID is parsed.
+	Mode = NumericUIDs
+
+	// MaxUIDLength is the maximum length of a user ID in bytes in StringUIDs mode.
+	MaxUIDLength = 64
+
+	// MaxStringUIDs is the maximum number of distinct string user IDs in use,
+	// so that the intern table can't grow without bound. Zero means unbounded.
+	MaxStringUIDs = 1 << 20
+
+	IncorrectUIDError = errors.New("user ID is empty or contains an invalid character")
+	UIDTooLongError   = errors.New("user ID is longer than the limit")
+	TooManyUIDsError  = errors.New("number of distinct user IDs is over the limit")
+)
+
+// names interns string user IDs, so that the rest of the server
+// handles every user ID as a number. IDs named by events are never
+// released, since sessions and follow graphs refer to them. IDs that
+// only user clients have sent are released once their last client
+// disconnects, so that clients can't fill the table for good.
+// New IDs are rejected while there are MaxStringUIDs of them.
+var names = struct {
+	sync.RWMutex
+
+	uids    map[string]UID
+	strings []string
+
+	// refs counts the handshakes holding each ID that isn't named by an event yet.
+	refs map[UID]int
+
+	// free contains the released IDs that can be assigned again.
+	free []UID
+}{
+	uids: make(map[string]UID),
+	refs: make(map[UID]int),
+}
+
 // ParseUID puts a given byte slice into a UID integer type.
+// In StringUIDs mode the ID is kept for as long as the server runs.
 func ParseUID(buf []byte) (UID, error) {
-	n, err := strconv.ParseUint(string(buf), 10, 64)
+	return parseUID(buf, false)
+}
+
+// parseUID parses a user ID like ParseUID. In StringUIDs mode, an ID parsed
+// from a handshake is referenced until it's released with ReleaseUID.
+func parseUID(buf []byte, isHandshake bool) (UID, error) {
+	if Mode == NumericUIDs {
+		n, err := strconv.ParseUint(string(buf), 10, 64)
+
+		return UID(n), err
+	}
+
+	if len(buf) > MaxUIDLength {
+		return 0, UIDTooLongError
+	}
+
+	if len(buf) == 0 || !utf8.Valid(buf) {
+		return 0, IncorrectUIDError
+	}
+
+	for _, c := range buf {
+		if c <= ' ' || c == '|' || c == 0x7f {
+			return 0, IncorrectUIDError
+		}
+	}
+
+	return intern(buf, isHandshake)
+}
+
+// intern returns the UID of the given string ID, assigning one if it's new.
+// Handshakes reference the ID, otherwise the ID is kept for good.
+func intern(buf []byte, isHandshake bool) (UID, error) {
+	if !isHandshake {
+		names.RLock()
+		// Map lookups with converted byte slices don't allocate.
+		uid, ok := names.uids[string(buf)]
+		_, isReferenced := names.refs[uid]
+		names.RUnlock()
+
+		if ok && !isReferenced {
+			return uid, nil
+		}
+	}
+
+	names.Lock()
+	defer names.Unlock()
+
+	uid, ok := names.uids[string(buf)]
+	if !ok {
+		if MaxStringUIDs > 0 && len(names.uids) >= MaxStringUIDs {
+			counters.Add("rejected uids", 1)
+
+			return 0, TooManyUIDsError
+		}
+
+		s := string(buf)
+
+		if n := len(names.free); n > 0 {
+			uid, names.free = names.free[n-1], names.free[:n-1]
+			names.strings[uid] = s
+		} else {
+			uid, names.strings = UID(len(names.strings)), append(names.strings, s)
+		}
+
+		names.uids[s] = uid
+
+		if isHandshake {
+			names.refs[uid] = 0
+		}
+	}
+
+	if n, isReferenced := names.refs[uid]; isReferenced {
+		if isHandshake {
+			names.refs[uid] = n + 1
+		} else {
+			delete(names.refs, uid)
+		}
+	}
+
+	return uid, nil
+}
+
+// ReleaseUID releases the reference of a handshake to the given user ID and
+// reports whether the ID is freed, i.e. no event has named it and no other
+// handshake references it. A freed ID may be assigned to another user, so
+// nothing should refer to it anymore.
+func ReleaseUID(uid UID) bool {
+	if Mode == NumericUIDs {
+		return false
+	}
+
+	names.Lock()
+	defer names.Unlock()
+
+	n, isReferenced := names.refs[uid]
+	switch {
+	case !isReferenced:
+		return false
+	case n > 1:
+		names.refs[uid] = n - 1
+		return false
+	}
+
+	delete(names.refs, uid)
+	delete(names.uids, names.strings[uid])
+
+	names.strings[uid] = ""
+	names.free = append(names.free, uid)
+
+	return true
+}
+
+// String returns the user ID as it's written on the wire.
+func (u UID) String() string {
+	if Mode == NumericUIDs {
+		return strconv.FormatUint(uint64(u), 10)
+	}
+
+	names.RLock()
+	defer names.RUnlock()
+
+	if uint64(u) >= uint64(len(names.strings)) || names.strings[u] == "" {
+		return fmt.Sprintf("UID(%d)", uint64(u))
+	}
+
+	return names.strings[u]
+}
+
+// AppendTo appends the user ID as it's written on the wire to dst
+// and returns the extended buffer.
+func (u UID) AppendTo(dst []byte) []byte {
+	if Mode == NumericUIDs {
+		return strconv.AppendUint(dst, uint64(u), 10)
+	}
 
-	return UID(n), err
+	return append(dst, u.String()...)
 }
 
 // UIDSet allows easy member tests where a collection of clients are kept.
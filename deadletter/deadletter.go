@@ -0,0 +1,204 @@
+// Package deadletter contains sinks for the events that are thrown away
+// by the server, e.g. malformed, duplicate or late events, so that
+// producer bugs can be investigated without debug logging.
+package deadletter
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"../client"
+	"../log"
+	"../protocol"
+	"../server"
+)
+
+// Letter is an event payload that has been thrown away.
+type Letter struct {
+	Payload   []byte
+	Reason    string
+	ArrivedAt time.Time
+}
+
+// String returns the letter as a single tab separated line.
+func (l Letter) String() string {
+	return fmt.Sprintf("%v\t%v\t%q\n", l.ArrivedAt.Format(time.RFC3339Nano), l.Reason, bytes.TrimRight(l.Payload, "\r\n"))
+}
+
+// Sink receives dead letters. Sinks are called from the ordering
+// goroutine, so they shouldn't block.
+type Sink func(Letter)
+
+// counters keeps the number of letters that sinks couldn't keep up with.
+var counters = expvar.NewMap("deadletter")
+
+// Tee returns a Sink that passes the letters to every given sink.
+func Tee(sinks ...Sink) Sink {
+	return func(l Letter) {
+		for _, sink := range sinks {
+			sink(l)
+		}
+	}
+}
+
+// Ring is an in-memory sink that keeps the most recent letters.
+type Ring struct {
+	mu      sync.Mutex
+	letters []Letter
+	next    int
+}
+
+// NewRing creates a Ring that keeps the given number of letters.
+func NewRing(size int) *Ring {
+	return &Ring{
+		letters: make([]Letter, 0, size),
+	}
+}
+
+// Put records the given letter, evicting the oldest one if the ring is full.
+// It can be used as a Sink.
+func (r *Ring) Put(l Letter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cap(r.letters) == 0 {
+		return
+	}
+
+	if len(r.letters) < cap(r.letters) {
+		r.letters = append(r.letters, l)
+		return
+	}
+
+	r.letters[r.next] = l
+	r.next = (r.next + 1) % len(r.letters)
+}
+
+// Letters returns the recorded letters from the oldest to the newest.
+func (r *Ring) Letters() []Letter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	letters := make([]Letter, 0, len(r.letters))
+	for i := range r.letters {
+		letters = append(letters, r.letters[(r.next+i)%len(r.letters)])
+	}
+
+	return letters
+}
+
+// Publish exposes the recorded letters as an expvar variable with the given name,
+// so that admins can inspect them through the /debug/vars endpoint.
+func (r *Ring) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		var lines []string
+		for _, l := range r.Letters() {
+			lines = append(lines, l.String())
+		}
+
+		return lines
+	}))
+}
+
+// File returns a Sink that appends letters to the file at the given path.
+// Letters are written from a dedicated goroutine, if it falls behind
+// more than the given number of letters, new letters are dropped.
+func File(path string, buffer int) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	letterCh := make(chan Letter, buffer)
+
+	go func() {
+		defer f.Close()
+
+		for l := range letterCh {
+			if _, err := f.WriteString(l.String()); err != nil {
+				log.Error(fmt.Sprintf("deadletter.File: while writing to %#q, got error %#q", path, err))
+			}
+		}
+	}()
+
+	return func(l Letter) {
+		select {
+		case letterCh <- l:
+		default:
+			counters.Add("dropped", 1)
+		}
+	}, nil
+}
+
+// TCP returns a Sink that sends letters to every consumer connecting
+// through the given listener. Consumers that fall behind more than
+// the given number of letters miss the new letters. Consumers are
+// expected not to send anything, reading only detects when they hang up.
+func TCP(accept protocol.Listener, buffer int) Sink {
+	var (
+		mu        sync.Mutex
+		consumers = make(map[chan Letter]struct{})
+	)
+
+	go func() {
+		err := server.Listen(accept, func(conn client.Interface) error {
+			defer conn.Close()
+
+			letterCh := make(chan Letter, buffer)
+
+			mu.Lock()
+			consumers[letterCh] = struct{}{}
+			mu.Unlock()
+
+			counters.Add("consumers", 1)
+
+			defer func() {
+				mu.Lock()
+				delete(consumers, letterCh)
+				mu.Unlock()
+
+				counters.Add("consumers", -1)
+			}()
+
+			hangupCh := make(chan struct{})
+			go func() {
+				defer close(hangupCh)
+
+				io.Copy(ioutil.Discard, struct{ io.Reader }{conn})
+			}()
+
+			for {
+				select {
+				case l := <-letterCh:
+					if _, err := conn.Write([]byte(l.String())); err != nil {
+						return nil
+					}
+				case <-hangupCh:
+					return nil
+				}
+			}
+		})
+		if err != nil {
+			log.Error(fmt.Sprintf("deadletter.TCP: stopped accepting consumers, got error %#q", err))
+		}
+	}()
+
+	return func(l Letter) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for letterCh := range consumers {
+			select {
+			case letterCh <- l:
+			default:
+				counters.Add("dropped", 1)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package deadletter_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"."
+	"../protocol"
+	"../testutil"
+)
+
+var arrivedAt = time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func letter(payload, reason string) deadletter.Letter {
+	return deadletter.Letter{Payload: []byte(payload), Reason: reason, ArrivedAt: arrivedAt}
+}
+
+func TestFormatsLetters(t *testing.T) {
+	expected := "2016-01-02T03:04:05Z\tlate\t\"1|B\"\n"
+
+	if got := letter("1|B\r\n", "late").String(); expected != got {
+		t.Errorf("deadletter.Letter.String() expected %#q, got %#q", expected, got)
+	}
+}
+
+func TestKeepsMostRecentLetters(t *testing.T) {
+	r := deadletter.NewRing(2)
+
+	for _, p := range []string{"1|B\n", "2|B\n", "3|B\n"} {
+		r.Put(letter(p, "late"))
+	}
+
+	letters := r.Letters()
+	if len(letters) != 2 {
+		t.Fatalf("deadletter.Ring.Letters() expected 2 letters, got %v", len(letters))
+	}
+
+	for i, expected := range []string{"2|B\n", "3|B\n"} {
+		if got := string(letters[i].Payload); expected != got {
+			t.Errorf("deadletter.Ring.Letters()[%v] expected %#q, got %#q", i, expected, got)
+		}
+	}
+}
+
+func TestAppendsLettersToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "deadletters.log")
+
+	sink, err := deadletter.File(path, 16)
+	if err != nil {
+		t.Fatalf("deadletter.File(%#q) got error %#q", path, err)
+	}
+
+	sink(letter("1|B\n", "late"))
+	sink(letter("2|X\n", "malformed"))
+
+	expected := letter("1|B\n", "late").String() + letter("2|X\n", "malformed").String()
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		buf, _ := ioutil.ReadFile(path)
+		if got := string(buf); got == expected {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("deadletter.File(%#q) expected file to contain %#q, got %#q", path, expected, got)
+		}
+	}
+}
+
+func TestSendsLettersToConsumers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen got error %v", err)
+	}
+	defer l.Close()
+
+	addr := l.Addr().String()
+
+	sink := deadletter.TCP(protocol.TCPOn(l), 16)
+
+	var conn net.Conn
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		var err error
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("net.Dial(%#q) got error %#q", addr, err)
+		}
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	// Consumers are registered asynchronously, letters are sent until one arrives.
+	lineCh := make(chan string)
+	go func() {
+		line, _ := r.ReadString('\n')
+		lineCh <- line
+	}()
+
+	expected := letter("1|B\n", "late").String()
+
+	for deadline := time.After(time.Second); ; {
+		sink(letter("1|B\n", "late"))
+
+		select {
+		case got := <-lineCh:
+			if expected != got {
+				t.Errorf("deadletter.TCP(%#q) expected consumer to receive %#q, got %#q", addr, expected, got)
+			}
+			return
+		case <-deadline:
+			t.Fatalf("deadletter.TCP(%#q) expected consumer to receive %#q", addr, strings.TrimSpace(expected))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func consumers() int64 {
+	return testutil.Counter("deadletter", "consumers")
+}
+
+// waitForConsumers waits until the number of connected consumers is the given one.
+func waitForConsumers(t *testing.T, n int64) {
+	for deadline := time.Now().Add(time.Second); consumers() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("deadletter.TCP expected %v consumers, got %v", n, consumers())
+		}
+	}
+}
+
+func TestDetectsConsumerHangups(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen got error %v", err)
+	}
+	defer l.Close()
+
+	deadletter.TCP(protocol.TCPOn(l), 16)
+
+	// Consumers of the other tests hang up as well.
+	waitForConsumers(t, 0)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(%#q) got error %v", l.Addr(), err)
+	}
+
+	waitForConsumers(t, 1)
+
+	conn.Close()
+
+	// The consumer goes away without any letters being sent.
+	waitForConsumers(t, 0)
+}
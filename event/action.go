@@ -0,0 +1,204 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Action denotes which type of event the packet is
+type Action int
+
+const (
+	BroadcastAction Action = 1 << iota
+	FollowAction
+	UnfollowAction
+	PrivateMessageAction
+	StatusUpdateAction
+)
+
+// MaxUIDs is the maximum number of user IDs an event packet contains.
+const MaxUIDs = 4
+
+var (
+	IncorrectActionCodeError = errors.New("action code is empty or contains a separator")
+	DuplicateActionError     = errors.New("action code is already registered")
+	IncorrectLayoutError     = errors.New("action layout contains too many user IDs")
+	TooManyActionsError      = errors.New("no more actions can be registered")
+	BuiltinActionError       = errors.New("built-in actions can't be unregistered")
+)
+
+// Layout describes the fields that follow the action code of an event packet.
+type Layout struct {
+	// UIDs is the number of user IDs the packet contains.
+	UIDs int
+
+	// Body denotes that the packet ends with an arbitrary field after the
+	// user IDs, which may contain anything except for the line terminator.
+	Body bool
+}
+
+// spec describes an action and its field layout.
+type spec struct {
+	action Action
+	code   string
+	layout Layout
+}
+
+// table contains the registered actions. It is never modified once it is
+// published, Register replaces it with a copy instead, so that the parser
+// can read it without locking.
+type table struct {
+	actions map[string]spec
+	codes   map[Action]string
+}
+
+var (
+	tables atomic.Value
+
+	// mu serializes the calls to Register and Unregister.
+	mu sync.Mutex
+
+	nextAction = StatusUpdateAction << 1
+
+	// freeActions contains the unregistered actions that can be reused.
+	freeActions []Action
+)
+
+func init() {
+	t := table{
+		actions: make(map[string]spec),
+		codes:   make(map[Action]string),
+	}
+
+	for _, s := range []spec{
+		{BroadcastAction, "B", Layout{UIDs: 0}},
+		{FollowAction, "F", Layout{UIDs: 2}},
+		{UnfollowAction, "U", Layout{UIDs: 2}},
+		{PrivateMessageAction, "P", Layout{UIDs: 2}},
+		{StatusUpdateAction, "S", Layout{UIDs: 1}},
+	} {
+		t.actions[s.code], t.codes[s.action] = s, s.code
+	}
+
+	tables.Store(t)
+}
+
+// Register declares a new action with the given code and field layout
+// and returns the Action that denotes it, so that Parse recognizes its packets.
+// e.g. Register("L", Layout{UIDs: 2}) for packets like `43|L|32|56\n`
+func Register(code string, layout Layout) (Action, error) {
+	if code == "" || strings.ContainsAny(code, "|\r\n") {
+		return 0, IncorrectActionCodeError
+	}
+
+	if layout.UIDs < 0 || layout.UIDs > MaxUIDs {
+		return 0, IncorrectLayoutError
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	old := tables.Load().(table)
+
+	if _, ok := old.actions[code]; ok {
+		return 0, DuplicateActionError
+	}
+
+	var action Action
+
+	switch n := len(freeActions); {
+	case n > 0:
+		action, freeActions = freeActions[n-1], freeActions[:n-1]
+	case nextAction > 0:
+		action = nextAction
+		nextAction <<= 1
+	default:
+		return 0, TooManyActionsError
+	}
+
+	t := old.clone()
+	t.actions[code], t.codes[action] = spec{action, code, layout}, code
+
+	tables.Store(t)
+
+	return action, nil
+}
+
+// Unregister removes an action declared with Register, so that its code
+// is no longer recognized and the Action may be reused by Register.
+// It is meant for cleaning up, e.g. in tests.
+func Unregister(a Action) error {
+	if a <= StatusUpdateAction {
+		return BuiltinActionError
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	old := tables.Load().(table)
+
+	code, ok := old.codes[a]
+	if !ok {
+		return UnknownActionError
+	}
+
+	t := old.clone()
+	delete(t.actions, code)
+	delete(t.codes, a)
+
+	tables.Store(t)
+
+	freeActions = append(freeActions, a)
+
+	return nil
+}
+
+// clone returns a copy of the table that can be modified before it's published.
+func (old table) clone() table {
+	t := table{
+		actions: make(map[string]spec, len(old.actions)+1),
+		codes:   make(map[Action]string, len(old.codes)+1),
+	}
+
+	for c, s := range old.actions {
+		t.actions[c] = s
+	}
+
+	for a, c := range old.codes {
+		t.codes[a] = c
+	}
+
+	return t
+}
+
+// lookup returns the spec of the action with the given code.
+func lookup(code []byte) (spec, bool) {
+	// Map lookups with converted byte slices don't allocate.
+	spec, ok := tables.Load().(table).actions[string(code)]
+
+	return spec, ok
+}
+
+// specOf returns the spec of the given action.
+func specOf(a Action) (spec, bool) {
+	t := tables.Load().(table)
+
+	code, ok := t.codes[a]
+	if !ok {
+		return spec{}, false
+	}
+
+	return t.actions[code], true
+}
+
+// String returns the code of the action.
+func (a Action) String() string {
+	if code, ok := tables.Load().(table).codes[a]; ok {
+		return code
+	}
+
+	return fmt.Sprintf("Action(%d)", int(a))
+}
@@ -0,0 +1,122 @@
+package event_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"."
+	"../client"
+)
+
+func TestRegistersActions(t *testing.T) {
+	like, err := event.Register("L", event.Layout{UIDs: 2})
+	if err != nil {
+		t.Fatalf("event.Register(%#q) got error %v", "L", err)
+	}
+	defer event.Unregister(like)
+
+	comment, err := event.Register("CM", event.Layout{UIDs: 1, Body: true})
+	if err != nil {
+		t.Fatalf("event.Register(%#q) got error %v", "CM", err)
+	}
+	defer event.Unregister(comment)
+
+	if like == comment || like&(event.BroadcastAction|event.FollowAction|event.UnfollowAction|event.PrivateMessageAction|event.StatusUpdateAction) != 0 {
+		t.Errorf("event.Register expected distinct actions, got %v and %v", int(like), int(comment))
+	}
+
+	packets := []struct {
+		Message string
+		Action  event.Action
+		UIDs    []client.UID
+		Body    string
+	}{
+		{"43|L|32|56\n", like, []client.UID{32, 56}, ""},
+		{"44|CM|32|Nice one | see you\r\n", comment, []client.UID{32}, "Nice one | see you"},
+		{"45|CM|32|\n", comment, []client.UID{32}, ""},
+	}
+
+	for _, pkt := range packets {
+		msg, err := event.Parse([]byte(pkt.Message))
+		if err != nil {
+			t.Errorf("event.Parse(%#q) got error %v", pkt.Message, err)
+			continue
+		}
+
+		if pkt.Action != msg.Action() {
+			t.Errorf("event.Parse(%#q) expected action %v, got %v", pkt.Message, pkt.Action, msg.Action())
+		}
+
+		if expected, got := fmt.Sprint(pkt.UIDs), fmt.Sprint(msg.UIDs()); expected != got {
+			t.Errorf("event.Parse(%#q) expected UIDs %v, got %v", pkt.Message, expected, got)
+		}
+
+		if pkt.Body != string(msg.Body()) {
+			t.Errorf("event.Parse(%#q) expected body %#q, got %#q", pkt.Message, pkt.Body, string(msg.Body()))
+		}
+	}
+
+	for _, msg := range []string{"43|L|32\n", "43|L|32|56|1\n", "44|CM|32\n", "44|CM\n"} {
+		if _, err := event.Parse([]byte(msg)); !errors.Is(err, event.IncorrectFormatError) {
+			t.Errorf("event.Parse(%#q) expected %q error, got %v", msg, event.IncorrectFormatError, err)
+		}
+	}
+
+	if expected, got := "CM", comment.String(); expected != got {
+		t.Errorf("event.Action.String() expected %#q, got %#q", expected, got)
+	}
+}
+
+func TestRejectsIncorrectActions(t *testing.T) {
+	tests := []struct {
+		code   string
+		layout event.Layout
+		err    error
+	}{
+		{"", event.Layout{}, event.IncorrectActionCodeError},
+		{"X|Y", event.Layout{}, event.IncorrectActionCodeError},
+		{"X\n", event.Layout{}, event.IncorrectActionCodeError},
+		{"F", event.Layout{UIDs: 2}, event.DuplicateActionError},
+		{"X", event.Layout{UIDs: event.MaxUIDs + 1}, event.IncorrectLayoutError},
+	}
+
+	for _, testCase := range tests {
+		if _, err := event.Register(testCase.code, testCase.layout); err != testCase.err {
+			t.Errorf("event.Register(%#q, %+v) expected error %v, got %v", testCase.code, testCase.layout, testCase.err, err)
+		}
+	}
+}
+
+func TestUnregistersActions(t *testing.T) {
+	vote, err := event.Register("V", event.Layout{UIDs: 1})
+	if err != nil {
+		t.Fatalf("event.Register(%#q) got error %v", "V", err)
+	}
+
+	if err := event.Unregister(vote); err != nil {
+		t.Fatalf("event.Unregister(%v) got error %v", vote, err)
+	}
+
+	if _, err := event.Parse([]byte("43|V|32\n")); !errors.Is(err, event.IncorrectFormatError) {
+		t.Errorf("event.Parse(%#q) expected an unregistered action to be rejected, got %v", "43|V|32\n", err)
+	}
+
+	if err := event.Unregister(vote); err != event.UnknownActionError {
+		t.Errorf("event.Unregister(%v) twice expected error %v, got %v", vote, event.UnknownActionError, err)
+	}
+
+	if err := event.Unregister(event.FollowAction); err != event.BuiltinActionError {
+		t.Errorf("event.Unregister(%v) expected error %v, got %v", event.FollowAction, event.BuiltinActionError, err)
+	}
+
+	again, err := event.Register("V", event.Layout{UIDs: 1})
+	if err != nil {
+		t.Fatalf("event.Register(%#q) after unregistering got error %v", "V", err)
+	}
+	defer event.Unregister(again)
+
+	if again != vote {
+		t.Errorf("event.Register(%#q) expected the unregistered action %v to be reused, got %v", "V", vote, again)
+	}
+}
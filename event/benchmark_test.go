@@ -0,0 +1,109 @@
+package event_test
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"."
+	"../client"
+)
+
+var benchmarkPayload = []byte("542532|F|1519210928|60\n")
+
+// regexpPattern and regexpParse are the regular expression based
+// implementation that event.Parse replaced, kept for comparison.
+var regexpPattern = regexp.MustCompile(`^\d+\|(([FUP]\|\d+\|\d+)|B|(S\|\d+))\n$`)
+
+func regexpParse(buf []byte) (uint64, string, []client.UID, error) {
+	msg := string(buf)
+
+	if !regexpPattern.MatchString(msg) {
+		return 0, "", nil, event.IncorrectFormatError
+	}
+
+	tokens := strings.Split(strings.TrimSuffix(msg, "\n"), "|")
+
+	seq, err := strconv.ParseUint(tokens[0], 10, 64)
+	if err != nil {
+		return 0, "", nil, err
+	}
+
+	var ts []client.UID
+	for _, token := range tokens[2:] {
+		n, err := client.ParseUID([]byte(token))
+		if err != nil {
+			return 0, "", nil, err
+		}
+
+		ts = append(ts, n)
+	}
+
+	return seq, tokens[1], ts, nil
+}
+
+func TestDecodesWithoutAllocations(t *testing.T) {
+	var f event.Fields
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := event.Decode(benchmarkPayload, &f); err != nil {
+			t.Fatalf("event.Decode(%#q) got error %v", string(benchmarkPayload), err)
+		}
+	})
+
+	if allocs != 0 {
+		t.Errorf("event.Decode(%#q) expected no allocations, got %v", string(benchmarkPayload), allocs)
+	}
+}
+
+func TestDecodesLikeRegexpParser(t *testing.T) {
+	payloads := []string{
+		"11|F|12|12\n", "11|B\n", "11|S|0\n", "0011|P|1|2\n",
+		"", "\n", "11|B", "11|B|\n", "11||B\n", "11|S|\n", "11|F|1|2|3\n",
+		"11|X|1|2\n", "a|B\n", "11|F|1|b\n", "11|F|1|2\n\n",
+	}
+
+	for _, payload := range payloads {
+		var f event.Fields
+
+		err := event.Decode([]byte(payload), &f)
+		seq, _, UIDs, regexpErr := regexpParse([]byte(payload))
+
+		if (err == nil) != (regexpErr == nil) {
+			t.Errorf("event.Decode(%#q) got error %v, regexp parser got error %v", payload, err, regexpErr)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if f.Sequence != seq || f.NumUIDs != len(UIDs) {
+			t.Errorf("event.Decode(%#q) got %+v, regexp parser got sequence %v and UIDs %v", payload, f, seq, UIDs)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	var f event.Fields
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		event.Decode(benchmarkPayload, &f)
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		event.Parse(benchmarkPayload)
+	}
+}
+
+func BenchmarkRegexpParse(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		regexpParse(benchmarkPayload)
+	}
+}
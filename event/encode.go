@@ -0,0 +1,111 @@
+package event
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"../client"
+)
+
+var (
+	UnknownActionError   = errors.New("action is not registered")
+	IncorrectFieldsError = errors.New("fields don't match the action layout")
+)
+
+// New builds a packet with the given fields in the canonical wire format,
+// i.e. `seq|code|uid...[|body]\r\n`. The number of user IDs and the body
+// are validated against the layout of the action.
+func New(seq uint64, action Action, body []byte, uids ...client.UID) (Packet, error) {
+	spec, ok := specOf(action)
+	if !ok {
+		return nil, UnknownActionError
+	}
+
+	if len(uids) != spec.layout.UIDs || (!spec.layout.Body && body != nil) || bytes.ContainsAny(body, "\r\n") {
+		return nil, IncorrectFieldsError
+	}
+
+	pkt := &packet{}
+
+	pkt.buffer = appendFields(nil, seq, spec, uids, body)
+
+	// Decoding the canonical payload makes the fields refer to it.
+	if err := Decode(pkt.buffer, &pkt.fields); err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
+
+// mustNew builds a packet of a built-in action, whose fields are always valid.
+func mustNew(seq uint64, action Action, body []byte, uids ...client.UID) Packet {
+	pkt, err := New(seq, action, body, uids...)
+	if err != nil {
+		panic(err)
+	}
+
+	return pkt
+}
+
+// Follow builds a packet in which from starts following to.
+func Follow(seq uint64, from, to client.UID) Packet {
+	return mustNew(seq, FollowAction, nil, from, to)
+}
+
+// Unfollow builds a packet in which from stops following to.
+func Unfollow(seq uint64, from, to client.UID) Packet {
+	return mustNew(seq, UnfollowAction, nil, from, to)
+}
+
+// Broadcast builds a packet that is sent to every user.
+func Broadcast(seq uint64) Packet {
+	return mustNew(seq, BroadcastAction, nil)
+}
+
+// PrivateMessage builds a packet in which from sends a message to to.
+func PrivateMessage(seq uint64, from, to client.UID) Packet {
+	return mustNew(seq, PrivateMessageAction, nil, from, to)
+}
+
+// StatusUpdate builds a packet in which from updates its status.
+func StatusUpdate(seq uint64, from client.UID) Packet {
+	return mustNew(seq, StatusUpdateAction, nil, from)
+}
+
+// Marshal returns the given packet in the canonical wire format.
+func Marshal(pkt Packet) []byte {
+	return AppendTo(nil, pkt)
+}
+
+// AppendTo appends the given packet in the canonical wire format to dst
+// and returns the extended buffer.
+// e.g. a packet parsed from `0042|F|60|50\n` is appended as `42|F|60|50\r\n`
+func AppendTo(dst []byte, pkt Packet) []byte {
+	s, ok := specOf(pkt.Action())
+	if !ok {
+		// Foreign Packet implementations may carry unregistered actions.
+		s = spec{code: pkt.Action().String(), layout: Layout{Body: pkt.Body() != nil}}
+	}
+
+	return appendFields(dst, pkt.Sequence(), s, pkt.UIDs(), pkt.Body())
+}
+
+// appendFields appends the given fields in the canonical wire format to dst.
+func appendFields(dst []byte, seq uint64, s spec, uids []client.UID, body []byte) []byte {
+	dst = strconv.AppendUint(dst, seq, 10)
+	dst = append(dst, '|')
+	dst = append(dst, s.code...)
+
+	for _, uid := range uids {
+		dst = append(dst, '|')
+		dst = uid.AppendTo(dst)
+	}
+
+	if s.layout.Body {
+		dst = append(dst, '|')
+		dst = append(dst, body...)
+	}
+
+	return append(dst, '\r', '\n')
+}
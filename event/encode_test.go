@@ -0,0 +1,107 @@
+package event_test
+
+import (
+	"fmt"
+	"testing"
+
+	"."
+	"../client"
+)
+
+func TestBuildsPackets(t *testing.T) {
+	tests := []struct {
+		Packet  event.Packet
+		Payload string
+		Action  event.Action
+		UIDs    []client.UID
+	}{
+		{event.Follow(666, 60, 50), "666|F|60|50\r\n", event.FollowAction, []client.UID{60, 50}},
+		{event.Unfollow(1, 12, 9), "1|U|12|9\r\n", event.UnfollowAction, []client.UID{12, 9}},
+		{event.Broadcast(542532), "542532|B\r\n", event.BroadcastAction, []client.UID{}},
+		{event.PrivateMessage(43, 32, 56), "43|P|32|56\r\n", event.PrivateMessageAction, []client.UID{32, 56}},
+		{event.StatusUpdate(634, 32), "634|S|32\r\n", event.StatusUpdateAction, []client.UID{32}},
+	}
+
+	for _, test := range tests {
+		if got := string(test.Packet.Payload()); test.Payload != got {
+			t.Errorf("event constructor expected payload %#q, got %#q", test.Payload, got)
+		}
+
+		if test.Action != test.Packet.Action() {
+			t.Errorf("event constructor for %#q expected action %v, got %v", test.Payload, test.Action, test.Packet.Action())
+		}
+
+		if expected, got := fmt.Sprint(test.UIDs), fmt.Sprint(test.Packet.UIDs()); expected != got {
+			t.Errorf("event constructor for %#q expected UIDs %v, got %v", test.Payload, expected, got)
+		}
+
+		if _, err := event.Parse(test.Packet.Payload()); err != nil {
+			t.Errorf("event.Parse(%#q) got error %v", test.Payload, err)
+		}
+	}
+}
+
+func TestBuildsRegisteredPackets(t *testing.T) {
+	reply, err := event.Register("RE", event.Layout{UIDs: 2, Body: true})
+	if err != nil {
+		t.Fatalf("event.Register(%#q) got error %v", "RE", err)
+	}
+	defer event.Unregister(reply)
+
+	pkt, err := event.New(7, reply, []byte("see | you"), 32, 56)
+	if err != nil {
+		t.Fatalf("event.New(%v) got error %v", reply, err)
+	}
+
+	if expected, got := "7|RE|32|56|see | you\r\n", string(pkt.Payload()); expected != got {
+		t.Errorf("event.New(%v) expected payload %#q, got %#q", reply, expected, got)
+	}
+
+	if expected, got := "see | you", string(pkt.Body()); expected != got {
+		t.Errorf("event.New(%v) expected body %#q, got %#q", reply, expected, got)
+	}
+
+	tests := []struct {
+		Action event.Action
+		Body   []byte
+		UIDs   []client.UID
+		Err    error
+	}{
+		{event.Action(1 << 30), nil, nil, event.UnknownActionError},
+		{event.FollowAction, nil, []client.UID{1}, event.IncorrectFieldsError},
+		{event.BroadcastAction, []byte("body"), nil, event.IncorrectFieldsError},
+		{reply, []byte("line\r\nbreak"), []client.UID{1, 2}, event.IncorrectFieldsError},
+	}
+
+	for _, test := range tests {
+		if _, err := event.New(1, test.Action, test.Body, test.UIDs...); err != test.Err {
+			t.Errorf("event.New(1, %v, %#q, %v) expected error %v, got %v", test.Action, test.Body, test.UIDs, test.Err, err)
+		}
+	}
+}
+
+func TestMarshalsPacketsCanonically(t *testing.T) {
+	tests := []struct {
+		Payload, Canonical string
+	}{
+		{"666|F|60|50\r\n", "666|F|60|50\r\n"},
+		{"0042|P|060|50\n", "42|P|60|50\r\n"},
+		{"542532|B\n", "542532|B\r\n"},
+	}
+
+	for _, test := range tests {
+		pkt, err := event.Parse([]byte(test.Payload))
+		if err != nil {
+			t.Fatalf("event.Parse(%#q) got error %v", test.Payload, err)
+		}
+
+		if got := string(event.Marshal(pkt)); test.Canonical != got {
+			t.Errorf("event.Marshal(%#q) expected %#q, got %#q", test.Payload, test.Canonical, got)
+		}
+
+		prefix := "prefix "
+		if expected, got := prefix+test.Canonical, string(event.AppendTo([]byte(prefix), pkt)); expected != got {
+			t.Errorf("event.AppendTo(%#q, %#q) expected %#q, got %#q", prefix, test.Payload, expected, got)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package event
+
+import "fmt"
+
+// ErrorKind denotes the reason a packet couldn't be parsed.
+type ErrorKind int
+
+const (
+	BadSequence ErrorKind = iota + 1
+	UnknownAction
+	WrongArity
+	BadUID
+	UIDOverflow
+	MissingTerminator
+)
+
+var errorKinds = map[ErrorKind]string{
+	BadSequence:       "bad sequence",
+	UnknownAction:     "unknown action",
+	WrongArity:        "wrong arity",
+	BadUID:            "bad uid",
+	UIDOverflow:       "uid overflow",
+	MissingTerminator: "missing terminator",
+}
+
+// String returns a short description of the error kind.
+func (k ErrorKind) String() string {
+	if s, ok := errorKinds[k]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// ParseError describes why and where an event packet couldn't be parsed.
+// It matches IncorrectFormatError when compared with errors.Is.
+type ParseError struct {
+	Kind ErrorKind
+
+	// Offset is the byte offset in the payload where the failure was detected.
+	Offset int
+
+	// Sequence is the sequence number of the packet, if HasSequence is set.
+	Sequence    uint64
+	HasSequence bool
+}
+
+func (e *ParseError) Error() string {
+	if e.HasSequence {
+		return fmt.Sprintf("%v: %v at byte %v of packet %v", IncorrectFormatError, e.Kind, e.Offset, e.Sequence)
+	}
+
+	return fmt.Sprintf("%v: %v at byte %v", IncorrectFormatError, e.Kind, e.Offset)
+}
+
+// Is reports whether the target is IncorrectFormatError.
+func (e *ParseError) Is(target error) bool {
+	return target == IncorrectFormatError
+}
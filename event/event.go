@@ -3,69 +3,197 @@ package event
 
 import (
 	"errors"
-	"regexp"
-	"strconv"
-	"strings"
 
 	"../client"
 )
 
-// Action denotes which type of event the packet is
-type Action int
-
-const (
-	BroadcastAction Action = 1 << iota
-	FollowAction
-	UnfollowAction
-	PrivateMessageAction
-	StatusUpdateAction
-)
-
 var (
 	IncorrectFormatError = errors.New("payload is formatted incorrectly")
 
-	eventPattern = regexp.MustCompile(`^\d+\|(([FUP]\|\d+\|\d+)|B|(S\|\d+))\n$`)
+	// StrictCRLF makes the parser accept only CRLF terminated packets
+	// as the protocol specifies instead of both CRLF and LF.
+	StrictCRLF = false
 )
 
-var actions = map[string]Action{
-	"B": BroadcastAction,
-	"F": FollowAction,
-	"U": UnfollowAction,
-	"P": PrivateMessageAction,
-	"S": StatusUpdateAction,
+// Fields contains the decoded fields of an event packet.
+type Fields struct {
+	Sequence uint64
+	Action   Action
+
+	// UIDs contains NumUIDs user IDs mentioned in the event packet.
+	UIDs    [MaxUIDs]client.UID
+	NumUIDs int
+
+	// Body refers to the body field of the payload if the action has one.
+	Body []byte
 }
 
-// Parse parses an event packet residing in a byte slice.
-func Parse(buf []byte) (Packet, error) {
-	msg := string(buf)
+// Decode validates an event packet residing in a byte slice and extracts
+// its fields into f in a single pass without any allocations.
+// If the packet is malformed, it returns a *ParseError.
+func Decode(buf []byte, f *Fields) error {
+	seq, i, ok := parseNumber(buf, 0)
+	if !ok {
+		return &ParseError{Kind: BadSequence, Offset: i}
+	}
 
-	if !eventPattern.MatchString(msg) {
-		return nil, IncorrectFormatError
+	fail := func(kind ErrorKind, offset int) error {
+		return &ParseError{Kind: kind, Offset: offset, Sequence: seq, HasSequence: true}
 	}
 
-	tokens := strings.Split(strings.TrimSuffix(msg, "\n"), "|")
+	switch {
+	case i >= len(buf):
+		return fail(MissingTerminator, i)
+	case buf[i] == '\r' || buf[i] == '\n':
+		return fail(UnknownAction, i)
+	case buf[i] != '|':
+		return &ParseError{Kind: BadSequence, Offset: i}
+	}
 
-	seq, err := strconv.ParseUint(tokens[0], 10, 64)
-	if err != nil {
-		return nil, err
+	start := i + 1
+	for i = start; i < len(buf) && buf[i] != '|' && buf[i] != '\r' && buf[i] != '\n'; i++ {
+	}
+
+	spec, ok := lookup(buf[start:i])
+	if !ok {
+		return fail(UnknownAction, start)
 	}
 
-	var ts []client.UID
-	for _, token := range tokens[2:] {
-		n, err := client.ParseUID([]byte(token))
-		if err != nil {
-			return nil, err
+	f.Sequence, f.Action, f.NumUIDs, f.Body = seq, spec.action, spec.layout.UIDs, nil
+
+	for n := 0; n < spec.layout.UIDs; n++ {
+		if i >= len(buf) || buf[i] != '|' {
+			return fail(WrongArity, i)
+		}
+
+		if client.Mode != client.NumericUIDs {
+			uid, next, err := parseString(buf, i+1)
+			switch err {
+			case nil:
+			case client.UIDTooLongError:
+				return fail(UIDOverflow, i+1)
+			default:
+				return fail(BadUID, i+1)
+			}
+
+			f.UIDs[n], i = uid, next
+			continue
 		}
 
-		ts = append(ts, n)
+		uid, next, ok := parseNumber(buf, i+1)
+		switch {
+		case !ok && next > i+1:
+			return fail(UIDOverflow, i+1)
+		case !ok:
+			return fail(BadUID, i+1)
+		}
+
+		f.UIDs[n], i = client.UID(uid), next
+	}
+
+	end := terminatorIndex(buf)
+	if end < 0 {
+		return fail(MissingTerminator, len(buf))
 	}
 
-	return packet{
-		seq:    seq,
-		action: actions[tokens[1]],
-		buffer: buf,
-		uIDs:   ts,
-	}, nil
+	if spec.layout.Body {
+		if i >= end || buf[i] != '|' {
+			return fail(WrongArity, i)
+		}
+
+		body := i + 1
+		f.Body, i = buf[body:end], end
+
+		// Body can't contain a line terminator.
+		for j, c := range f.Body {
+			if c == '\r' || c == '\n' {
+				return fail(MissingTerminator, body+j)
+			}
+		}
+	}
+
+	switch {
+	case i == end:
+		return nil
+	case buf[i] == '|':
+		return fail(WrongArity, i)
+	case buf[i] == '\r' || buf[i] == '\n':
+		return fail(MissingTerminator, i)
+	default:
+		return fail(BadUID, i)
+	}
+}
+
+// terminatorIndex returns the index where the line terminator of the packet
+// begins or -1 if the packet isn't terminated properly.
+func terminatorIndex(buf []byte) int {
+	end := len(buf) - 1
+	if end < 0 || buf[end] != '\n' {
+		return -1
+	}
+
+	if end > 0 && buf[end-1] == '\r' {
+		return end - 1
+	}
+
+	if StrictCRLF {
+		return -1
+	}
+
+	return end
+}
+
+// parseNumber parses the decimal number starting at buf[i] and returns
+// it along with the index of the first byte after the number.
+// If the number overflows, it returns the index of the overflowing digit.
+func parseNumber(buf []byte, i int) (n uint64, end int, ok bool) {
+	const cutoff = ^uint64(0)/10 + 1
+
+	for end = i; end < len(buf); end++ {
+		c := buf[end]
+		if c < '0' || c > '9' {
+			break
+		}
+
+		if n >= cutoff {
+			return 0, end, false
+		}
+
+		n *= 10
+
+		d := uint64(c - '0')
+		if n+d < n {
+			return 0, end, false
+		}
+
+		n += d
+	}
+
+	return n, end, end > i
+}
+
+// parseString parses the string user ID starting at buf[i] and returns
+// it along with the index of the first byte after the user ID.
+func parseString(buf []byte, i int) (uid client.UID, end int, err error) {
+	for end = i; end < len(buf) && buf[end] != '|' && buf[end] != '\r' && buf[end] != '\n'; end++ {
+	}
+
+	uid, err = client.ParseUID(buf[i:end])
+
+	return uid, end, err
+}
+
+// Parse parses an event packet residing in a byte slice.
+// The returned packet refers to the given byte slice as its payload,
+// so the payload is forwarded exactly as it is received.
+func Parse(buf []byte) (Packet, error) {
+	pkt := &packet{buffer: buf}
+
+	if err := Decode(buf, &pkt.fields); err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
 }
 
 // Packet contains behavior of an event.Packet.
@@ -75,36 +203,40 @@ type Packet interface {
 	Action() Action
 	Sequence() uint64
 	UIDs() []client.UID
+	Body() []byte
 }
 
 type packet struct {
-	seq    uint64
-	action Action
+	fields Fields
 	buffer []byte
-	uIDs   []client.UID
 }
 
 // Sequence returns the sequence number of the packet.
-func (m packet) Sequence() uint64 {
-	return m.seq
+func (m *packet) Sequence() uint64 {
+	return m.fields.Sequence
 }
 
 // Sequence returns the string form of the payload.
-func (m packet) String() string {
+func (m *packet) String() string {
 	return string(m.Payload())
 }
 
 // Sequence returns payload in a byte slice.
-func (m packet) Payload() []byte {
+func (m *packet) Payload() []byte {
 	return m.buffer
 }
 
 // UIDs returns the user IDs mentioned in the event.Packet.
-func (m packet) UIDs() []client.UID {
-	return m.uIDs
+func (m *packet) UIDs() []client.UID {
+	return m.fields.UIDs[:m.fields.NumUIDs]
 }
 
 // Action denotes the type of event.Packet.
-func (m packet) Action() Action {
-	return m.action
+func (m *packet) Action() Action {
+	return m.fields.Action
+}
+
+// Body returns the body field of the packet if its action has one.
+func (m *packet) Body() []byte {
+	return m.fields.Body
 }
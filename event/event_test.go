@@ -1,6 +1,7 @@
 package event_test
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 
@@ -58,7 +59,7 @@ func TestParsesIncorrectlyFormattedPackets(t *testing.T) {
 		payload := []byte(msg)
 
 		_, err := event.Parse(payload)
-		if expectedErr := event.IncorrectFormatError; expectedErr != err {
+		if expectedErr := event.IncorrectFormatError; !errors.Is(err, expectedErr) {
 			t.Errorf("event.Parse(%#q) expected %q error, got %v", msg, expectedErr, err)
 		}
 	}
@@ -102,6 +103,18 @@ func TestParsesPayloads(t *testing.T) {
 			Message:  "11|B\n",
 			UIDs:     []client.UID{},
 		},
+		{
+			Sequence: 666,
+			Action:   event.FollowAction,
+			Message:  "666|F|60|50\r\n",
+			UIDs:     []client.UID{60, 50},
+		},
+		{
+			Sequence: 542532,
+			Action:   event.BroadcastAction,
+			Message:  "542532|B\r\n",
+			UIDs:     []client.UID{},
+		},
 	}
 
 	for _, pkt := range packets {
@@ -124,5 +137,117 @@ func TestParsesPayloads(t *testing.T) {
 		if expected, got := fmt.Sprint(pkt.UIDs), fmt.Sprint(msg.UIDs()); expected != got {
 			t.Errorf("event.Parse(%#q) expected action %v, got %v", pkt.Message, expected, got)
 		}
+
+		if expected, got := pkt.Message, string(msg.Payload()); expected != got {
+			t.Errorf("event.Parse(%#q) expected payload to be forwarded as is, got %#q", expected, got)
+		}
+	}
+}
+
+func TestParsesIncorrectlyTerminatedPackets(t *testing.T) {
+	packets := []string{
+		"11|B\r",
+		"11|B\r\r\n",
+		"11|B\n\r",
+		"11|S|12\r\r\n",
+		"11|F|12|13\r",
+	}
+
+	for _, msg := range packets {
+		if _, err := event.Parse([]byte(msg)); !errors.Is(err, event.IncorrectFormatError) {
+			t.Errorf("event.Parse(%#q) expected %q error, got %v", msg, event.IncorrectFormatError, err)
+		}
+	}
+}
+
+func TestParsesOnlyCRLFTerminatedPacketsInStrictMode(t *testing.T) {
+	defer func(strict bool) {
+		event.StrictCRLF = strict
+	}(event.StrictCRLF)
+
+	event.StrictCRLF = true
+
+	if _, err := event.Parse([]byte("666|F|60|50\r\n")); err != nil {
+		t.Errorf("event.Parse(%#q) in strict mode got error %v", "666|F|60|50\r\n", err)
+	}
+
+	if _, err := event.Parse([]byte("666|F|60|50\n")); !errors.Is(err, event.IncorrectFormatError) {
+		t.Errorf("event.Parse(%#q) in strict mode expected %q error, got %v", "666|F|60|50\n", event.IncorrectFormatError, err)
+	}
+}
+
+func TestReportsParseErrors(t *testing.T) {
+	tests := []struct {
+		msg string
+		err event.ParseError
+	}{
+		{"", event.ParseError{Kind: event.BadSequence}},
+		{"F\n", event.ParseError{Kind: event.BadSequence}},
+		{"11\\|B\n", event.ParseError{Kind: event.BadSequence, Offset: 2}},
+		{"18446744073709551616|B\n", event.ParseError{Kind: event.BadSequence, Offset: 19}},
+		{"11\n", event.ParseError{Kind: event.UnknownAction, Offset: 2, Sequence: 11, HasSequence: true}},
+		{"11|PM|12\n", event.ParseError{Kind: event.UnknownAction, Offset: 3, Sequence: 11, HasSequence: true}},
+		{"11|P|12\n", event.ParseError{Kind: event.WrongArity, Offset: 7, Sequence: 11, HasSequence: true}},
+		{"11|U|21|11|1\n", event.ParseError{Kind: event.WrongArity, Offset: 10, Sequence: 11, HasSequence: true}},
+		{"11|F|U|11\n", event.ParseError{Kind: event.BadUID, Offset: 5, Sequence: 11, HasSequence: true}},
+		{"11|S|12a\n", event.ParseError{Kind: event.BadUID, Offset: 7, Sequence: 11, HasSequence: true}},
+		{"11|S|18446744073709551616\n", event.ParseError{Kind: event.UIDOverflow, Offset: 5, Sequence: 11, HasSequence: true}},
+		{"11|B", event.ParseError{Kind: event.MissingTerminator, Offset: 4, Sequence: 11, HasSequence: true}},
+		{"11", event.ParseError{Kind: event.MissingTerminator, Offset: 2, Sequence: 11, HasSequence: true}},
+		{"11|B\r\r\n", event.ParseError{Kind: event.MissingTerminator, Offset: 4, Sequence: 11, HasSequence: true}},
+	}
+
+	for _, testCase := range tests {
+		_, err := event.Parse([]byte(testCase.msg))
+
+		parseErr, ok := err.(*event.ParseError)
+		if !ok {
+			t.Errorf("event.Parse(%#q) expected a *event.ParseError, got %v", testCase.msg, err)
+			continue
+		}
+
+		if *parseErr != testCase.err {
+			t.Errorf("event.Parse(%#q) expected %+v, got %+v", testCase.msg, testCase.err, *parseErr)
+		}
+	}
+}
+
+func TestParsesStringUIDs(t *testing.T) {
+	defer func(mode client.UIDMode, length int) {
+		client.Mode, client.MaxUIDLength = mode, length
+	}(client.Mode, client.MaxUIDLength)
+
+	client.Mode, client.MaxUIDLength = client.StringUIDs, 8
+
+	msg := "43|P|alice|bob\r\n"
+
+	pkt, err := event.Parse([]byte(msg))
+	if err != nil {
+		t.Fatalf("event.Parse(%#q) got error %v", msg, err)
+	}
+
+	if expected, got := "[alice bob]", fmt.Sprint(pkt.UIDs()); expected != got {
+		t.Errorf("event.Parse(%#q) expected UIDs %v, got %v", msg, expected, got)
+	}
+
+	if got := string(event.Marshal(pkt)); msg != got {
+		t.Errorf("event.Marshal(event.Parse(%#q)) got %#q", msg, got)
+	}
+
+	tests := []struct {
+		msg string
+		err event.ParseError
+	}{
+		{"11|S|\n", event.ParseError{Kind: event.BadUID, Offset: 5, Sequence: 11, HasSequence: true}},
+		{"11|S|a b\n", event.ParseError{Kind: event.BadUID, Offset: 5, Sequence: 11, HasSequence: true}},
+		{"11|S|too-long-id\n", event.ParseError{Kind: event.UIDOverflow, Offset: 5, Sequence: 11, HasSequence: true}},
+	}
+
+	for _, testCase := range tests {
+		_, err := event.Parse([]byte(testCase.msg))
+
+		if parseErr, ok := err.(*event.ParseError); !ok || *parseErr != testCase.err {
+			t.Errorf("event.Parse(%#q) expected %+v, got %v", testCase.msg, testCase.err, err)
+		}
 	}
 }
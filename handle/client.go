@@ -2,24 +2,74 @@ package handle
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
 
 	"../client"
 	"../log"
+	"../protocol"
 )
 
+// WriteTimeout is how long writing a notification to a user client may take
+// before the client is disconnected. Zero means no limit.
+var WriteTimeout = protocol.TCP_TIMEOUT
+
 // Client manages communications to/from a client.Interface.
-// Returns a channel that signals when a connection lifetime has ended.
-func Client(conn client.Interface, payloadCh <-chan client.Payloader) {
-	go func(payloadCh <-chan client.Payloader) {
-		defer conn.Close()
+// Returns a channel that signals when a connection lifetime has ended,
+// i.e. the client hung up, a read or write failed or payloadCh is closed.
+// A client that doesn't accept a packet within WriteTimeout is disconnected.
+func Client(conn client.Interface, payloadCh <-chan client.Payloader) <-chan struct{} {
+	doneCh := make(chan struct{})
+
+	var once sync.Once
+	end := func() {
+		once.Do(func() {
+			conn.Close()
+			close(doneCh)
+		})
+	}
+
+	// User clients don't send anything after the handshake,
+	// reading only detects when they hang up.
+	go func() {
+		defer end()
 
+		// Hides the io.WriterTo of the connection, if any, so that only Read is used.
+		if _, err := io.Copy(ioutil.Discard, struct{ io.Reader }{conn}); err != nil {
+			log.Debug(fmt.Sprintf("handle.Client: while reading from a client, got error %#q", err))
+		}
+	}()
+
+	d, hasDeadline := conn.(deadliner)
+	timeout := WriteTimeout
+
+	go func(payloadCh <-chan client.Payloader) {
 		for pkt := range payloadCh {
+			if hasDeadline && timeout > 0 {
+				d.SetWriteDeadline(time.Now().Add(timeout))
+			}
+
 			_, err := conn.Write(pkt.Payload())
+			if isTimeout(err) {
+				log.Info(fmt.Sprintf("handle.Client: client didn't accept a packet in %v, disconnecting", timeout))
+				counters.Add("write timeouts", 1)
+				break
+			}
+
 			if err != nil {
 				log.Debug(fmt.Sprintf("handle.Client: while forwarding packets to a client, got error %#q", err))
-				return
+				break
 			}
 		}
 
+		end()
+
+		// Discards the rest, so that the session queue never blocks on a dead client.
+		for range payloadCh {
+		}
 	}(payloadCh)
+
+	return doneCh
 }
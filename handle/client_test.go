@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"net"
 	"testing"
+	"time"
 
 	"../client"
 	"../handle"
@@ -16,21 +18,38 @@ func (p payload) Payload() []byte {
 	return []byte(p)
 }
 
+// idle is a connection reader that blocks like a user client that doesn't send anything.
+type idle struct{}
+
+func (idle) Read([]byte) (int, error) {
+	select {}
+}
+
 type buffer struct {
 	bytes.Buffer
-	io.Closer
+}
+
+func (buf *buffer) Read(p []byte) (int, error) {
+	return idle{}.Read(p)
+}
+
+func (buf *buffer) Close() error {
+	return nil
 }
 
 func TestSendsMessageToClientEmitter(t *testing.T) {
 	msg := "12|B|12|2323\n"
 
 	recorder, payloadCh := new(buffer), make(chan client.Payloader)
-	defer close(payloadCh)
 
-	handle.Client(recorder, payloadCh)
+	doneCh := handle.Client(recorder, payloadCh)
 
 	payloadCh <- payload(msg)
 
+	// Waits for the writer to finish before inspecting the recorded output.
+	close(payloadCh)
+	<-doneCh
+
 	if expected, got := msg, recorder.String(); got != expected {
 		t.Errorf("handle.Client expected msg %#q, got %#q", expected, got)
 	}
@@ -55,6 +74,7 @@ func TestChecksReleaseOfResources(t *testing.T) {
 	msg := "12|B|12|2323\n"
 
 	c := &mockBuffer{
+		Reader:   idle{},
 		isClosed: make(chan bool, 1),
 	}
 
@@ -69,3 +89,58 @@ func TestChecksReleaseOfResources(t *testing.T) {
 		t.Error("handle.Client should have closed `payloadCh` channel after client.Interface has been closed")
 	}
 }
+
+func TestDetectsClientHangups(t *testing.T) {
+	conn, peer := net.Pipe()
+
+	payloadCh := make(chan client.Payloader)
+	defer close(payloadCh)
+
+	doneCh := handle.Client(conn, payloadCh)
+
+	peer.Close()
+
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatal("handle.Client should have signaled the end of the connection after the client hung up")
+	}
+
+	// Payloads sent after the connection has ended are discarded.
+	select {
+	case payloadCh <- payload("12|B\n"):
+	case <-time.After(time.Second):
+		t.Error("handle.Client should keep discarding payloads after the connection has ended")
+	}
+}
+
+func TestDisconnectsStuckClients(t *testing.T) {
+	defer func(timeout time.Duration) {
+		handle.WriteTimeout = timeout
+	}(handle.WriteTimeout)
+
+	handle.WriteTimeout = 20 * time.Millisecond
+
+	// The peer never reads, so writes block like on a full TCP window.
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	payloadCh := make(chan client.Payloader)
+	defer close(payloadCh)
+
+	timeouts := counter("write timeouts")
+
+	doneCh := handle.Client(conn, payloadCh)
+
+	payloadCh <- payload("12|B\n")
+
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatal("handle.Client should have disconnected the client after the write deadline expired")
+	}
+
+	if expected, got := timeouts+1, counter("write timeouts"); expected != got {
+		t.Errorf("handle.Client expected %v write timeouts, got %v", expected, got)
+	}
+}
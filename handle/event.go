@@ -3,69 +3,263 @@
 package handle
 
 import (
+	"expvar"
 	"fmt"
+	"time"
 
 	"../client"
+	"../deadletter"
 	"../event"
 	"../log"
 	"../notify"
 )
 
+var (
+	// StartingIndex is the sequence number of the first packet to be delivered.
+	StartingIndex uint64 = 1
+
+	// Skip decides when a missing packet is considered lost.
+	Skip SkipPolicy = Greedy(1*time.Second, 10*time.Second)
+
+	// SkipCheckInterval is how often a stalled window consults Skip.
+	SkipCheckInterval = 100 * time.Millisecond
+
+	// MaxWindow is the maximum number of packets that are buffered
+	// while waiting for a missing packet. Zero means unbounded.
+	MaxWindow = 1 << 20
+
+	// MaxWindowBytes is the approximate maximum memory in bytes that the
+	// buffered packets may occupy. Zero means unbounded.
+	MaxWindowBytes = 256 << 20
+
+	// Overflow decides what happens to a packet that doesn't fit in the window.
+	// BlockPolicy relies on Skip to free the window, so it must not be
+	// combined with Never, which would block the event sources forever.
+	Overflow = AdvancePolicy
+
+	// GracePeriod is how long a Stream keeps waiting for missing packets
+	// after every event source has disconnected.
+	GracePeriod = 30 * time.Second
+
+	// Grace decides what happens to the buffered packets of a Stream
+	// once the grace period is over.
+	Grace = FlushPolicy
+
+	// Checkpoint, if set, returns a closure that records the delivery progress.
+	// It is sent to the client.Registry every CheckpointInterval right after
+	// the packet preceding the given index.
+	Checkpoint func(index uint64) client.RegistryFunc
+
+	// CheckpointInterval is how often Checkpoint is sent to the client.Registry.
+	CheckpointInterval = time.Second
+
+	// OnRelease, if set, is called with every packet as it is released in order,
+	// e.g. to append it to a journal. It is called from the ordering goroutine,
+	// so it shouldn't block.
+	OnRelease func(pkt event.Packet)
+
+	// DeadLetter, if set, receives the payloads that are thrown away, i.e.
+	// malformed, duplicate, late, rejected and discarded packets.
+	// It is called from the ordering goroutine, so it shouldn't block.
+	DeadLetter deadletter.Sink
+)
+
+// GracePolicy denotes what to do with the buffered packets when
+// event sources don't reconnect in time.
+type GracePolicy int
+
 const (
-	startingIndex = 1
+	// FlushPolicy skips the missing packets and releases the buffered ones.
+	FlushPolicy GracePolicy = iota
+
+	// DiscardPolicy drops the buffered packets and keeps waiting for the missing one.
+	DiscardPolicy
 )
 
+var (
+	// counters keeps the packet handling statistics, e.g. number of skipped packets.
+	counters = expvar.NewMap("handle")
+
+	// parseErrors keeps the number of malformed packets per event.ErrorKind.
+	parseErrors = new(expvar.Map).Init()
+)
+
+func init() {
+	counters.Set("parse errors", parseErrors)
+}
+
 // Events funnels out-of-order packets and sends them in a sorted fashiong
 // as client.RegistryFunc closures.
+// Missing packets are skipped when the Skip policy decides that they are lost
+// and packets that don't fit in the window are handled according to Overflow.
 func Events(payloadCh <-chan []byte, registryCh chan<- client.RegistryFunc) {
-	packets := make(map[uint64]client.RegistryFunc)
+	events(payloadCh, nil, registryCh)
+}
 
-	go func(payloadCh <-chan []byte, registryCh chan<- client.RegistryFunc) {
-		var index uint64 = startingIndex
+// events is the implementation of Events that keeps track of the connected
+// event sources as well, if a source channel is given.
+// Each event source sends 1 when it connects and -1 when it disconnects.
+// While there are no sources connected, missing packets aren't skipped
+// until the grace period is over.
+func events(payloadCh <-chan []byte, sourceCh <-chan int, registryCh chan<- client.RegistryFunc) {
+	skip, interval, overflow := Skip, SkipCheckInterval, Overflow
+	gracePeriod, grace := GracePeriod, Grace
+	checkpoint, checkpointInterval := Checkpoint, CheckpointInterval
+	onRelease, deadLetter := OnRelease, DeadLetter
+
+	w := newWindow(StartingIndex, MaxWindow, MaxWindowBytes)
 
+	go func(payloadCh <-chan []byte, registryCh chan<- client.RegistryFunc) {
 		defer close(registryCh)
 
-		for payload := range payloadCh {
-			pkt, err := event.Parse(payload)
-			if err != nil {
-				// TODO(tmrts): might try to read the packet sequence no and skip that packet
-				//              to make sure the flow continues.
-				log.Debug(fmt.Sprintf("event.Parse(%#q) got error %#q", string(payload), err))
-				continue
+		// Number of connected event sources and the last time it dropped to zero.
+		var sources int
+		disconnectedAt := time.Now()
+
+		lastCheckpoint := time.Now()
+
+		bury := func(payload []byte, reason string, arrivedAt time.Time) {
+			if deadLetter != nil {
+				deadLetter(deadletter.Letter{Payload: payload, Reason: reason, ArrivedAt: arrivedAt})
 			}
+		}
 
-			seq := pkt.Sequence()
-			// Ignores packets with same sequence numbers or
-			// lower than current index numbers.
-			if _, ok := packets[seq]; !ok && seq >= index {
-				packets[seq] = notify.FuncFor(pkt)
+		send := func(pkt event.Packet) {
+			if onRelease != nil {
+				onRelease(pkt)
 			}
 
-			for {
-				pkt, ok := packets[index]
-				if !ok {
-					break
-				}
+			registryCh <- notify.FuncFor(pkt)
+		}
 
-				registryCh <- pkt
+		// Packet that is held back while the source is blocked and its arrival time.
+		var (
+			pending   event.Packet
+			pendingAt time.Time
+		)
 
-				// Evicts used event packets
-				// NOTE: Bulk delete might increase performance
-				delete(packets, index)
+		// Becomes nil while the event source is blocked.
+		inputCh := payloadCh
 
-				index++
+		accept := func(pkt event.Packet, arrivedAt time.Time) {
+			if !w.fits(pkt) {
+				switch overflow {
+				case BlockPolicy:
+					pending, pendingAt, inputCh = pkt, arrivedAt, nil
+					return
+				case AdvancePolicy:
+					for !w.fits(pkt) {
+						w.skip()
+						w.release(send)
+					}
+				case RejectPolicy:
+					log.Debug(fmt.Sprintf("handle.Events: window is full, rejected packet %v", pkt.Sequence()))
+					counters.Add("rejected", 1)
+					bury(pkt.Payload(), "rejected", arrivedAt)
+					return
+				}
+			}
+
+			if reason := w.ignores(pkt.Sequence()); reason != "" {
+				log.Debug(fmt.Sprintf("handle.Events: ignored %v packet %v", reason, pkt.Sequence()))
+				bury(pkt.Payload(), reason, arrivedAt)
+				return
+			}
+
+			if w.insert(pkt, arrivedAt) {
+				w.release(send)
 			}
 		}
 
-		// Send the remaning events
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
 		for {
-			pkt, ok := packets[index]
-			if !ok {
-				break
-			}
+			select {
+			case payload, ok := <-inputCh:
+				if !ok {
+					// Send the remaning events
+					w.release(send)
+					return
+				}
+
+				arrivedAt := time.Now()
+
+				pkt, err := event.Parse(payload)
+				if err != nil {
+					log.Debug(fmt.Sprintf("event.Parse(%#q) got error %#q", string(payload), err))
+					bury(payload, "malformed: "+err.Error(), arrivedAt)
+
+					parseErr, ok := err.(*event.ParseError)
+					if !ok {
+						continue
+					}
+
+					parseErrors.Add(parseErr.Kind.String(), 1)
+
+					// Skips the malformed packet to make sure the flow continues.
+					if parseErr.HasSequence && w.forfeit(parseErr.Sequence) {
+						w.release(send)
+					}
+
+					continue
+				}
+
+				accept(pkt, arrivedAt)
+			case n := <-sourceCh:
+				sources += n
+
+				switch {
+				case sources == 0:
+					disconnectedAt = time.Now()
+				case sources == n:
+					// Time spent without any sources doesn't count towards skipping.
+					w.stalledSince = time.Now()
+				}
+			case now := <-ticker.C:
+				w.tick(now)
 
-			registryCh <- pkt
-			index++
+				switch {
+				case sourceCh == nil || sources > 0:
+					if skip(w.stats(now)) {
+						w.skip()
+						w.release(send)
+					}
+				case len(w.packets) > 0 && now.Sub(disconnectedAt) >= gracePeriod:
+					switch grace {
+					case FlushPolicy:
+						log.Info(fmt.Sprintf("handle.Events: event sources didn't reconnect in %v, flushing %v packets", gracePeriod, len(w.packets)))
+
+						for len(w.packets) > 0 {
+							w.skip()
+							w.release(send)
+						}
+					case DiscardPolicy:
+						log.Info(fmt.Sprintf("handle.Events: event sources didn't reconnect in %v, discarding %v packets", gracePeriod, len(w.packets)))
+
+						for _, b := range w.packets {
+							if b.pkt != nil {
+								bury(b.pkt.Payload(), "discarded", b.arrivedAt)
+							}
+						}
+
+						w.discard()
+					}
+				}
+
+				if pending != nil && w.fits(pending) {
+					pkt, arrivedAt := pending, pendingAt
+					pending, inputCh = nil, payloadCh
+
+					accept(pkt, arrivedAt)
+				}
+
+				if checkpoint != nil && now.Sub(lastCheckpoint) >= checkpointInterval {
+					registryCh <- checkpoint(w.index)
+
+					lastCheckpoint = now
+				}
+			}
 		}
 	}(payloadCh, registryCh)
 }
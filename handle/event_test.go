@@ -1,10 +1,17 @@
 package handle_test
 
 import (
+	"expvar"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"."
 	"../client"
+	"../deadletter"
+	"../event"
+	"../testutil"
 )
 
 func TestHandlesEvents(t *testing.T) {
@@ -41,6 +48,7 @@ func TestHandlesEvents(t *testing.T) {
 
 	registryCh <- client.RegisterFunc(12, payloadCh12)
 
+	// Closing the input channel releases the remaining packets and terminates the client.Registry.
 	inputCh := make(chan []byte)
 	defer close(inputCh)
 
@@ -62,3 +70,317 @@ func TestHandlesEvents(t *testing.T) {
 		}
 	}
 }
+
+func TestSkipsLostPackets(t *testing.T) {
+	defer func(skip handle.SkipPolicy, interval time.Duration) {
+		handle.Skip, handle.SkipCheckInterval = skip, interval
+	}(handle.Skip, handle.SkipCheckInterval)
+
+	handle.Skip = handle.Greedy(0, 0)
+	handle.SkipCheckInterval = time.Millisecond
+
+	registryCh := client.NewRegistry()
+
+	payloadCh := make(chan client.Payloader, 3)
+
+	registryCh <- client.RegisterFunc(12, payloadCh)
+
+	skipped := counter("skipped")
+
+	inputCh := make(chan []byte)
+
+	handle.Events(inputCh, registryCh)
+
+	for _, p := range []string{"1|B\n", "4|B\n", "5|B\n"} {
+		inputCh <- []byte(p)
+	}
+
+	for _, expected := range []string{"1|B\n", "4|B\n", "5|B\n"} {
+		if got := string((<-payloadCh).Payload()); expected != got {
+			t.Errorf("handle.Events => expected lost packets to be skipped, should have got %#q, but received %#q", expected, got)
+		}
+	}
+
+	if expected, got := skipped+2, counter("skipped"); expected != got {
+		t.Errorf("handle.Events => expected %v packets to be counted as skipped, got %v", expected-skipped, got-skipped)
+	}
+}
+
+func TestBoundsWindowOnOverflow(t *testing.T) {
+	defer func(skip handle.SkipPolicy, maxWindow int, overflow handle.OverflowPolicy) {
+		handle.Skip, handle.MaxWindow, handle.Overflow = skip, maxWindow, overflow
+	}(handle.Skip, handle.MaxWindow, handle.Overflow)
+
+	handle.Skip = handle.Never
+	handle.MaxWindow = 2
+
+	tests := []struct {
+		overflow handle.OverflowPolicy
+		input    []string
+		expected []string
+		counter  string
+	}{
+		{
+			overflow: handle.AdvancePolicy,
+			input:    []string{"1|B\n", "3|B\n", "4|B\n", "6|B\n", "5|B\n"},
+			expected: []string{"1|B\n", "3|B\n", "4|B\n", "5|B\n", "6|B\n"},
+			counter:  "skipped",
+		},
+		{
+			overflow: handle.RejectPolicy,
+			input:    []string{"1|B\n", "3|B\n", "4|B\n", "5|B\n", "2|B\n"},
+			expected: []string{"1|B\n", "2|B\n", "3|B\n", "4|B\n"},
+			counter:  "rejected",
+		},
+	}
+
+	for _, testCase := range tests {
+		handle.Overflow = testCase.overflow
+
+		registryCh := client.NewRegistry()
+
+		payloadCh := make(chan client.Payloader, len(testCase.expected))
+
+		registryCh <- client.RegisterFunc(12, payloadCh)
+
+		count := counter(testCase.counter)
+
+		inputCh := make(chan []byte)
+
+		handle.Events(inputCh, registryCh)
+
+		for _, p := range testCase.input {
+			inputCh <- []byte(p)
+		}
+
+		for _, expected := range testCase.expected {
+			if got := string((<-payloadCh).Payload()); expected != got {
+				t.Errorf("handle.Events => with overflow policy %v, should have got %#q, but received %#q", testCase.overflow, expected, got)
+			}
+		}
+
+		if expected, got := count+1, counter(testCase.counter); expected != got {
+			t.Errorf("handle.Events => with overflow policy %v, expected %#q counter to be %v, got %v", testCase.overflow, testCase.counter, expected, got)
+		}
+	}
+}
+
+func TestBlocksEventSourceOnOverflow(t *testing.T) {
+	defer func(skip handle.SkipPolicy, interval time.Duration, maxWindow int, overflow handle.OverflowPolicy) {
+		handle.Skip, handle.SkipCheckInterval, handle.MaxWindow, handle.Overflow = skip, interval, maxWindow, overflow
+	}(handle.Skip, handle.SkipCheckInterval, handle.MaxWindow, handle.Overflow)
+
+	var isLost int32
+
+	handle.Skip = func(handle.Stats) bool {
+		return atomic.LoadInt32(&isLost) == 1
+	}
+	handle.SkipCheckInterval = time.Millisecond
+	handle.MaxWindow = 2
+	handle.Overflow = handle.BlockPolicy
+
+	registryCh := client.NewRegistry()
+
+	payloadCh := make(chan client.Payloader, 5)
+
+	registryCh <- client.RegisterFunc(12, payloadCh)
+
+	inputCh := make(chan []byte)
+
+	handle.Events(inputCh, registryCh)
+
+	for _, p := range []string{"1|B\n", "3|B\n", "4|B\n", "5|B\n"} {
+		inputCh <- []byte(p)
+	}
+
+	select {
+	case inputCh <- []byte("6|B\n"):
+		t.Fatal("handle.Events => expected event source to be blocked while the window is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	atomic.StoreInt32(&isLost, 1)
+
+	inputCh <- []byte("6|B\n")
+
+	for _, expected := range []string{"1|B\n", "3|B\n", "4|B\n", "5|B\n", "6|B\n"} {
+		if got := string((<-payloadCh).Payload()); expected != got {
+			t.Errorf("handle.Events => expected blocked packets to be released in order, should have got %#q, but received %#q", expected, got)
+		}
+	}
+}
+
+func TestCheckpointsDeliveredIndex(t *testing.T) {
+	defer func(startingIndex uint64, interval time.Duration, checkpoint func(uint64) client.RegistryFunc, checkpointInterval time.Duration) {
+		handle.StartingIndex, handle.SkipCheckInterval, handle.Checkpoint, handle.CheckpointInterval = startingIndex, interval, checkpoint, checkpointInterval
+	}(handle.StartingIndex, handle.SkipCheckInterval, handle.Checkpoint, handle.CheckpointInterval)
+
+	indexCh := make(chan uint64, 1)
+
+	handle.StartingIndex = 40
+	handle.SkipCheckInterval = time.Millisecond
+	handle.CheckpointInterval = time.Millisecond
+	handle.Checkpoint = func(index uint64) client.RegistryFunc {
+		return func(client.Registry) error {
+			select {
+			case indexCh <- index:
+			default:
+			}
+
+			return nil
+		}
+	}
+
+	registryCh := client.NewRegistry()
+
+	payloadCh := make(chan client.Payloader, 2)
+
+	registryCh <- client.RegisterFunc(12, payloadCh)
+
+	inputCh := make(chan []byte)
+
+	handle.Events(inputCh, registryCh)
+
+	for _, p := range []string{"1|B\n", "41|B\n", "40|B\n"} {
+		inputCh <- []byte(p)
+	}
+
+	for _, expected := range []string{"40|B\n", "41|B\n"} {
+		if got := string((<-payloadCh).Payload()); expected != got {
+			t.Errorf("handle.Events => expected delivery to start from handle.StartingIndex, should have got %#q, but received %#q", expected, got)
+		}
+	}
+
+	// Drains the checkpoints taken before the packets were delivered.
+	for index := <-indexCh; index != 42; index = <-indexCh {
+		if index != 40 {
+			t.Fatalf("handle.Events => expected checkpoints for index 40 or 42, got %v", index)
+		}
+	}
+}
+
+func TestCallsOnReleaseInOrder(t *testing.T) {
+	defer func(onRelease func(event.Packet)) {
+		handle.OnRelease = onRelease
+	}(handle.OnRelease)
+
+	releaseCh := make(chan string, 3)
+
+	handle.OnRelease = func(pkt event.Packet) {
+		releaseCh <- pkt.String()
+	}
+
+	registryCh := client.NewRegistry()
+
+	inputCh := make(chan []byte)
+
+	handle.Events(inputCh, registryCh)
+
+	for _, p := range []string{"2|B\n", "3|B\n", "1|B\n"} {
+		inputCh <- []byte(p)
+	}
+
+	for _, expected := range []string{"1|B\n", "2|B\n", "3|B\n"} {
+		if got := <-releaseCh; expected != got {
+			t.Errorf("handle.OnRelease => expected packets in order, should have got %#q, but received %#q", expected, got)
+		}
+	}
+}
+
+func TestSkipsMalformedNumberedPackets(t *testing.T) {
+	defer func(skip handle.SkipPolicy) {
+		handle.Skip = skip
+	}(handle.Skip)
+
+	handle.Skip = handle.Never
+
+	registryCh := client.NewRegistry()
+
+	payloadCh := make(chan client.Payloader, 2)
+
+	registryCh <- client.RegisterFunc(12, payloadCh)
+
+	unknownActions := parseErrors(event.UnknownAction)
+
+	inputCh := make(chan []byte)
+
+	handle.Events(inputCh, registryCh)
+
+	for _, p := range []string{"1|B\n", "3|B\n", "2|X|12\n"} {
+		inputCh <- []byte(p)
+	}
+
+	for _, expected := range []string{"1|B\n", "3|B\n"} {
+		if got := string((<-payloadCh).Payload()); expected != got {
+			t.Errorf("handle.Events => expected malformed packets to be skipped, should have got %#q, but received %#q", expected, got)
+		}
+	}
+
+	if expected, got := unknownActions+1, parseErrors(event.UnknownAction); expected != got {
+		t.Errorf("handle.Events => expected %v parse errors of kind %q, got %v", expected, event.UnknownAction, got)
+	}
+}
+
+func TestSendsIgnoredPacketsToDeadLetter(t *testing.T) {
+	defer func(sink deadletter.Sink) {
+		handle.DeadLetter = sink
+	}(handle.DeadLetter)
+
+	letterCh := make(chan deadletter.Letter, 3)
+
+	handle.DeadLetter = func(l deadletter.Letter) {
+		letterCh <- l
+	}
+
+	registryCh := client.NewRegistry()
+
+	payloadCh := make(chan client.Payloader, 2)
+
+	registryCh <- client.RegisterFunc(12, payloadCh)
+
+	inputCh := make(chan []byte)
+
+	handle.Events(inputCh, registryCh)
+
+	for _, p := range []string{"1|B\n", "3|B\n", "3|B\n", "1|B\n", "2|X\n"} {
+		inputCh <- []byte(p)
+	}
+
+	expectations := []struct {
+		payload, reason string
+	}{
+		{"3|B\n", "duplicate"},
+		{"1|B\n", "late"},
+		{"2|X\n", "malformed"},
+	}
+
+	for _, expected := range expectations {
+		l := <-letterCh
+
+		if string(l.Payload) != expected.payload || !strings.HasPrefix(l.Reason, expected.reason) {
+			t.Errorf("handle.Events => expected dead letter %#q with reason %q, got %#q with reason %q", expected.payload, expected.reason, l.Payload, l.Reason)
+		}
+
+		if l.ArrivedAt.IsZero() {
+			t.Errorf("handle.Events => expected dead letter %#q to have an arrival time", l.Payload)
+		}
+	}
+}
+
+func parseErrors(kind event.ErrorKind) int64 {
+	m, ok := expvar.Get("handle").(*expvar.Map).Get("parse errors").(*expvar.Map)
+	if !ok {
+		return 0
+	}
+
+	n, ok := m.Get(kind.String()).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+
+	return n.Value()
+}
+
+func counter(name string) int64 {
+	return testutil.Counter("handle", name)
+}
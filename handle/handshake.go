@@ -0,0 +1,172 @@
+package handle
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"time"
+
+	"../client"
+	"../log"
+)
+
+var (
+	// HandshakeTimeout is how long a user client has to identify itself
+	// after connecting. Zero means no limit.
+	HandshakeTimeout = 10 * time.Second
+
+	// Identity decides how the identity of an authenticated connection,
+	// e.g. the subject of a mutual TLS client certificate, identifies a user client.
+	Identity = IgnoreIdentity
+
+	HandshakeTimeoutError = errors.New("user client didn't identify in time")
+	UnverifiedPeerError   = errors.New("user client isn't authenticated")
+	IdentityMismatchError = errors.New("user ID doesn't match the authenticated identity")
+)
+
+// IdentityPolicy denotes how the identity of an authenticated connection is used.
+// Unless the policy is IgnoreIdentity, connections without authentication,
+// e.g. plain TCP or WebSocket, are rejected.
+type IdentityPolicy int
+
+const (
+	// IgnoreIdentity identifies user clients by the identification line only.
+	IgnoreIdentity IdentityPolicy = iota
+
+	// VerifyIdentity requires the identification line to match the identity.
+	VerifyIdentity
+
+	// TrustIdentity identifies user clients by the identity without reading
+	// an identification line, so they can't resume.
+	TrustIdentity
+)
+
+// handshakeErrors keeps the number of rejected handshakes per reason.
+var handshakeErrors = new(expvar.Map).Init()
+
+func init() {
+	counters.Set("rejected handshakes", handshakeErrors)
+}
+
+// identifier is implemented by connections that authenticate their peer, e.g. protocol.TLSConn.
+type identifier interface {
+	Identity() (string, bool)
+}
+
+// deadliner is implemented by connections that support deadlines, e.g. net.Conn.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// Handshake reads the identification line of a user client within HandshakeTimeout
+// and checks it against the identity of the connection according to Identity.
+// If the client doesn't identify properly, the reason is written back to the client,
+// e.g. `ERR invalid uid\r\n`, and the connection is closed.
+func Handshake(conn client.Interface) (client.Handshake, error) {
+	d, hasDeadline := conn.(deadliner)
+
+	if hasDeadline && HandshakeTimeout > 0 {
+		deadline := time.Now().Add(HandshakeTimeout)
+
+		d.SetReadDeadline(deadline)
+		d.SetWriteDeadline(deadline)
+	}
+
+	if hasDeadline {
+		defer d.SetWriteDeadline(time.Time{})
+	}
+
+	// Identity of the peer, if the connection is authenticated.
+	var (
+		peer      client.UID
+		checkPeer bool
+	)
+
+	if Identity != IgnoreIdentity {
+		id, ok := conn.(identifier)
+		if !ok {
+			return client.Handshake{}, reject(conn, "unverified peer", UnverifiedPeerError)
+		}
+
+		name, ok := id.Identity()
+		if !ok {
+			return client.Handshake{}, reject(conn, "unverified peer", UnverifiedPeerError)
+		}
+
+		uid, err := client.ParseUID([]byte(name))
+		if err != nil {
+			return client.Handshake{}, reject(conn, "invalid uid", err)
+		}
+
+		if Identity == TrustIdentity {
+			if hasDeadline {
+				d.SetReadDeadline(time.Time{})
+			}
+
+			return client.Handshake{UID: uid}, nil
+		}
+
+		peer, checkPeer = uid, true
+	}
+
+	rdr := bufio.NewReader(conn)
+
+	// Trims the line-feed at the end
+	line, isPrefix, err := rdr.ReadLine()
+	switch {
+	case isTimeout(err):
+		return client.Handshake{}, reject(conn, "handshake timeout", HandshakeTimeoutError)
+	case err != nil:
+		conn.Close()
+		handshakeErrors.Add("read error", 1)
+
+		return client.Handshake{}, err
+	case isPrefix:
+		return client.Handshake{}, reject(conn, "invalid handshake", client.IncorrectHandshakeError)
+	}
+
+	h, err := client.ParseHandshake(line)
+	switch {
+	case err == client.IncorrectHandshakeError:
+		return client.Handshake{}, reject(conn, "invalid handshake", err)
+	case err != nil:
+		return client.Handshake{}, reject(conn, "invalid uid", err)
+	case checkPeer && h.UID != peer:
+		client.ReleaseUID(h.UID)
+
+		return client.Handshake{}, reject(conn, "identity mismatch", IdentityMismatchError)
+	}
+
+	if hasDeadline {
+		d.SetReadDeadline(time.Time{})
+	}
+
+	return h, nil
+}
+
+// isTimeout reports whether the given error is caused by an expired deadline.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+
+	return ok && netErr.Timeout()
+}
+
+// reject writes the reason of the rejection to the user client and closes the connection.
+func reject(conn client.Interface, reason string, err error) error {
+	defer conn.Close()
+
+	handshakeErrors.Add(reason, 1)
+
+	log.Debug(fmt.Sprintf("handle.Handshake: rejected a user client, got error %#q", err))
+
+	if d, ok := conn.(deadliner); ok && HandshakeTimeout > 0 {
+		d.SetWriteDeadline(time.Now().Add(HandshakeTimeout))
+	}
+
+	conn.Write([]byte("ERR " + reason + "\r\n"))
+
+	return err
+}
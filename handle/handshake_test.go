@@ -0,0 +1,191 @@
+package handle_test
+
+import (
+	"bufio"
+	"expvar"
+	"net"
+	"testing"
+	"time"
+
+	"."
+	"../client"
+)
+
+func TestIdentifiesUserClients(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+
+	go peer.Write([]byte("2932 resume 184467\r\n"))
+
+	h, err := handle.Handshake(conn)
+	if err != nil {
+		t.Fatalf("handle.Handshake got error %v", err)
+	}
+
+	if expected := (client.Handshake{UID: 2932, Resume: true, Since: 184467}); h != expected {
+		t.Errorf("handle.Handshake expected %+v, got %+v", expected, h)
+	}
+}
+
+func TestRejectsUserClients(t *testing.T) {
+	defer func(timeout time.Duration) {
+		handle.HandshakeTimeout = timeout
+	}(handle.HandshakeTimeout)
+
+	handle.HandshakeTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		line, reply, reason string
+	}{
+		{"abc\r\n", "ERR invalid uid\r\n", "invalid uid"},
+		{"2932 rewind 1\r\n", "ERR invalid handshake\r\n", "invalid handshake"},
+		{"", "ERR handshake timeout\r\n", "handshake timeout"},
+	}
+
+	for _, testCase := range tests {
+		conn, peer := net.Pipe()
+
+		rejected := handshakeErrors(testCase.reason)
+
+		errCh := make(chan error)
+		go func() {
+			_, err := handle.Handshake(conn)
+			errCh <- err
+		}()
+
+		if testCase.line != "" {
+			peer.Write([]byte(testCase.line))
+		}
+
+		reply, err := bufio.NewReader(peer).ReadString('\n')
+		if err != nil || reply != testCase.reply {
+			t.Errorf("handle.Handshake(%#q) expected reply %#q, got %#q and error %v", testCase.line, testCase.reply, reply, err)
+		}
+
+		if err := <-errCh; err == nil {
+			t.Errorf("handle.Handshake(%#q) expected an error, got none", testCase.line)
+		}
+
+		// The connection should be closed after the reply.
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := peer.Read(make([]byte, 1)); isTimeout(err) {
+			t.Errorf("handle.Handshake(%#q) expected the connection to be closed", testCase.line)
+		}
+
+		if expected, got := rejected+1, handshakeErrors(testCase.reason); expected != got {
+			t.Errorf("handle.Handshake(%#q) expected %v rejected handshakes due to %q, got %v", testCase.line, expected, testCase.reason, got)
+		}
+
+		peer.Close()
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+
+	return ok && netErr.Timeout()
+}
+
+func handshakeErrors(reason string) int64 {
+	m, ok := expvar.Get("handle").(*expvar.Map).Get("rejected handshakes").(*expvar.Map)
+	if !ok {
+		return 0
+	}
+
+	n, ok := m.Get(reason).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+
+	return n.Value()
+}
+
+// authenticated is a connection whose peer is authenticated as the given name.
+type authenticated struct {
+	net.Conn
+	name string
+}
+
+func (c authenticated) Identity() (string, bool) {
+	return c.name, c.name != ""
+}
+
+func TestChecksIdentityOfAuthenticatedClients(t *testing.T) {
+	defer func(identity handle.IdentityPolicy) {
+		handle.Identity = identity
+	}(handle.Identity)
+
+	tests := []struct {
+		identity   handle.IdentityPolicy
+		name, line string
+		uid        client.UID
+		reply      string
+	}{
+		{handle.IgnoreIdentity, "2932", "15\r\n", 15, ""},
+		{handle.VerifyIdentity, "2932", "2932\r\n", 2932, ""},
+		{handle.VerifyIdentity, "2932", "15\r\n", 0, "ERR identity mismatch\r\n"},
+		{handle.VerifyIdentity, "", "15\r\n", 0, "ERR unverified peer\r\n"},
+		{handle.TrustIdentity, "2932", "", 2932, ""},
+	}
+
+	for _, testCase := range tests {
+		handle.Identity = testCase.identity
+
+		conn, peer := net.Pipe()
+
+		go peer.Write([]byte(testCase.line))
+
+		replyCh := make(chan string, 1)
+		go func() {
+			reply, _ := bufio.NewReader(peer).ReadString('\n')
+			replyCh <- reply
+		}()
+
+		h, err := handle.Handshake(authenticated{conn, testCase.name})
+		if (err != nil) != (testCase.reply != "") {
+			t.Errorf("handle.Handshake(%#q) with identity %#q expected reply %#q, got error %v", testCase.line, testCase.name, testCase.reply, err)
+		}
+
+		if h.UID != testCase.uid {
+			t.Errorf("handle.Handshake(%#q) with identity %#q expected UID %v, got %v", testCase.line, testCase.name, testCase.uid, h.UID)
+		}
+
+		conn.Close()
+
+		if reply := <-replyCh; reply != testCase.reply {
+			t.Errorf("handle.Handshake(%#q) with identity %#q expected reply %#q, got %#q", testCase.line, testCase.name, testCase.reply, reply)
+		}
+
+		peer.Close()
+	}
+}
+
+func TestRejectsUnauthenticatedClients(t *testing.T) {
+	defer func(identity handle.IdentityPolicy) {
+		handle.Identity = identity
+	}(handle.Identity)
+
+	for _, identity := range []handle.IdentityPolicy{handle.VerifyIdentity, handle.TrustIdentity} {
+		handle.Identity = identity
+
+		conn, peer := net.Pipe()
+
+		go peer.Write([]byte("2932\r\n"))
+
+		replyCh := make(chan string, 1)
+		go func() {
+			reply, _ := bufio.NewReader(peer).ReadString('\n')
+			replyCh <- reply
+		}()
+
+		if _, err := handle.Handshake(conn); err != handle.UnverifiedPeerError {
+			t.Errorf("handle.Handshake with identity policy %v expected error %v for a connection without authentication, got %v", identity, handle.UnverifiedPeerError, err)
+		}
+
+		if expected, reply := "ERR unverified peer\r\n", <-replyCh; reply != expected {
+			t.Errorf("handle.Handshake with identity policy %v expected reply %#q, got %#q", identity, expected, reply)
+		}
+
+		peer.Close()
+	}
+}
@@ -0,0 +1,85 @@
+package handle
+
+import (
+	"math"
+	"time"
+)
+
+// Stats is a snapshot of a stalled reorder window that a SkipPolicy
+// uses to decide whether the missing packet is lost.
+type Stats struct {
+	// Index is the sequence number that is being waited for.
+	Index uint64
+
+	// MaxSeen is the highest sequence number received so far.
+	MaxSeen uint64
+
+	// Buffered is the number of packets waiting behind the missing one.
+	Buffered int
+
+	// Rate is the estimated packet arrival rate in packets per second.
+	Rate float64
+
+	// Waited is the time passed since the window got stalled on Index.
+	Waited time.Duration
+}
+
+// Missing returns the number of sequence numbers up to MaxSeen
+// that haven't arrived yet.
+func (s Stats) Missing() uint64 {
+	if s.MaxSeen < s.Index {
+		return 0
+	}
+
+	return s.MaxSeen - s.Index + 1 - uint64(s.Buffered)
+}
+
+// ExpectedWait is the worst-case time it takes for every missing packet
+// to arrive with the current arrival rate.
+// e.g. (2000 - 500) / 150 = 10 seconds
+func (s Stats) ExpectedWait() time.Duration {
+	if s.Rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+
+	wait := float64(s.Missing()) / s.Rate * float64(time.Second)
+	if wait >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+
+	return time.Duration(wait)
+}
+
+// SkipPolicy reports whether the packet numbered Stats.Index should be
+// considered lost so that the packets buffered behind it can be released.
+type SkipPolicy func(Stats) bool
+
+// Greedy returns a SkipPolicy that gives up on a missing packet once the
+// window has been stalled for longer than the expected wait time.
+// The expected wait time is clamped to [min, max], so that a burst of
+// out-of-order packets isn't skipped prematurely and a stalled source
+// doesn't hold the window forever.
+func Greedy(min, max time.Duration) SkipPolicy {
+	return func(s Stats) bool {
+		if s.Buffered == 0 {
+			return false
+		}
+
+		limit := s.ExpectedWait()
+		if limit < min {
+			limit = min
+		}
+
+		if limit > max {
+			limit = max
+		}
+
+		return s.Waited >= limit
+	}
+}
+
+// Never is a SkipPolicy that waits for missing packets indefinitely.
+// It shouldn't be combined with the BlockPolicy overflow policy.
+func Never(Stats) bool {
+	return false
+}
@@ -0,0 +1,45 @@
+package handle_test
+
+import (
+	"testing"
+	"time"
+
+	"."
+)
+
+func TestEstimatesExpectedWait(t *testing.T) {
+	stats := handle.Stats{
+		Index:    1,
+		MaxSeen:  2000,
+		Buffered: 500,
+		Rate:     150,
+	}
+
+	if expected, got := 10*time.Second, stats.ExpectedWait(); got < expected-time.Millisecond || got > expected+time.Millisecond {
+		t.Errorf("handle.Stats%+v.ExpectedWait() expected %v, got %v", stats, expected, got)
+	}
+}
+
+func TestGreedilySkipsStalledPackets(t *testing.T) {
+	skip := handle.Greedy(time.Second, 10*time.Second)
+
+	tests := []struct {
+		stats    handle.Stats
+		expected bool
+	}{
+		// Nothing is buffered, so there is nothing to be gained.
+		{handle.Stats{Index: 1, Waited: time.Hour}, false},
+		// Burst of out-of-order packets.
+		{handle.Stats{Index: 1, MaxSeen: 3, Buffered: 1, Rate: 1000, Waited: 100 * time.Millisecond}, false},
+		{handle.Stats{Index: 1, MaxSeen: 2000, Buffered: 500, Rate: 150, Waited: 5 * time.Second}, false},
+		{handle.Stats{Index: 1, MaxSeen: 2000, Buffered: 500, Rate: 150, Waited: 11 * time.Second}, true},
+		// Source has stalled.
+		{handle.Stats{Index: 1, MaxSeen: 3, Buffered: 1, Waited: 10 * time.Second}, true},
+	}
+
+	for _, testCase := range tests {
+		if got := skip(testCase.stats); got != testCase.expected {
+			t.Errorf("handle.Greedy(1s, 10s)(%+v) expected %v, got %v", testCase.stats, testCase.expected, got)
+		}
+	}
+}
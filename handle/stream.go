@@ -0,0 +1,66 @@
+package handle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"../client"
+	"../log"
+)
+
+// Stream is a single ordering stage that every event source connection
+// feeds into, so that multiple event sources share the same sequence space.
+// The ordering state outlives the source connections, so a reconnecting
+// source continues from the next undelivered sequence number.
+type Stream struct {
+	payloadCh chan []byte
+	sourceCh  chan int
+}
+
+// NewStream creates a Stream that funnels the packets of its sources
+// into the given client.Registry channel in order.
+func NewStream(registryCh chan<- client.RegistryFunc) *Stream {
+	s := &Stream{
+		payloadCh: make(chan []byte),
+		sourceCh:  make(chan int),
+	}
+
+	events(s.payloadCh, s.sourceCh, registryCh)
+
+	return s
+}
+
+// Source reads the packets sent by an event source connection and feeds
+// them into the stream until the connection is closed.
+// A source disconnecting doesn't affect the stream or the other sources.
+func (s *Stream) Source(conn client.Interface) error {
+	defer conn.Close()
+
+	s.sourceCh <- 1
+	defer func() {
+		s.sourceCh <- -1
+	}()
+
+	rdr := bufio.NewReader(conn)
+
+	for {
+		payload, err := rdr.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Error(fmt.Sprintf("handle.Stream: event source thrown read error %#q", err))
+			}
+
+			break
+		}
+
+		// No more to read close the loop
+		if len(payload) == 0 {
+			break
+		}
+
+		s.payloadCh <- payload
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+package handle_test
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"."
+	"../client"
+	"../deadletter"
+)
+
+type source struct {
+	io.Reader
+}
+
+func (src source) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func (src source) Close() error {
+	return nil
+}
+
+func TestSharesSequenceSpaceBetweenSources(t *testing.T) {
+	registryCh := client.NewRegistry()
+
+	payloadCh := make(chan client.Payloader, 5)
+
+	registryCh <- client.RegisterFunc(12, payloadCh)
+
+	stream := handle.NewStream(registryCh)
+
+	var wg sync.WaitGroup
+	for _, packets := range []string{"1|B\n3|B\n", "4|B\n2|B\n"} {
+		wg.Add(1)
+
+		go func(packets string) {
+			defer wg.Done()
+
+			stream.Source(source{strings.NewReader(packets)})
+		}(packets)
+	}
+
+	wg.Wait()
+
+	// Sources disconnecting shouldn't affect the sequence.
+	stream.Source(source{strings.NewReader("5|B\n")})
+
+	for _, expected := range []string{"1|B\n", "2|B\n", "3|B\n", "4|B\n", "5|B\n"} {
+		if got := string((<-payloadCh).Payload()); expected != got {
+			t.Errorf("handle.Stream => expected packets from every source in order, should have got %#q, but received %#q", expected, got)
+		}
+	}
+}
+
+func TestContinuesSequenceAfterReconnection(t *testing.T) {
+	defer func(skip handle.SkipPolicy, interval, gracePeriod time.Duration, checkpoint func(uint64) client.RegistryFunc, checkpointInterval time.Duration) {
+		handle.Skip, handle.SkipCheckInterval, handle.GracePeriod = skip, interval, gracePeriod
+		handle.Checkpoint, handle.CheckpointInterval = checkpoint, checkpointInterval
+	}(handle.Skip, handle.SkipCheckInterval, handle.GracePeriod, handle.Checkpoint, handle.CheckpointInterval)
+
+	handle.SkipCheckInterval = time.Millisecond
+	handle.GracePeriod = time.Hour
+
+	// Every tick of the ordering stage ends with a checkpoint.
+	tickCh := make(chan struct{}, 1)
+
+	handle.CheckpointInterval = 0
+	handle.Checkpoint = func(uint64) client.RegistryFunc {
+		select {
+		case tickCh <- struct{}{}:
+		default:
+		}
+
+		return func(client.Registry) error {
+			return nil
+		}
+	}
+
+	// Records every time the ordering stage considers skipping, but never skips.
+	statsCh := make(chan handle.Stats, 1)
+
+	handle.Skip = func(stats handle.Stats) bool {
+		select {
+		case statsCh <- stats:
+		default:
+		}
+
+		return false
+	}
+
+	registryCh := client.NewRegistry()
+
+	payloadCh := make(chan client.Payloader, 3)
+
+	registryCh <- client.RegisterFunc(12, payloadCh)
+
+	stream := handle.NewStream(registryCh)
+
+	stream.Source(source{strings.NewReader("1|B\n3|B\n")})
+
+	if expected, got := "1|B\n", string((<-payloadCh).Payload()); expected != got {
+		t.Errorf("handle.Stream => should have got %#q, but received %#q", expected, got)
+	}
+
+	// The source has disconnected once Source returns, waits for a full tick after that.
+	disconnectedAt := time.Now()
+
+	select {
+	case <-statsCh:
+	default:
+	}
+
+	<-tickCh
+	<-tickCh
+
+	// Missing packets shouldn't be considered for skipping while the source is disconnected.
+	select {
+	case <-statsCh:
+		t.Errorf("handle.Stream => expected to wait for the source to reconnect, but considered skipping")
+	default:
+	}
+
+	rdr, wr := io.Pipe()
+
+	reconnectedAt := time.Now()
+
+	go stream.Source(source{rdr})
+
+	// Time spent without any sources shouldn't count towards skipping.
+	if stats := <-statsCh; stats.Waited > time.Since(reconnectedAt) {
+		t.Errorf("handle.Stream => expected the wait to start at reconnection %v ago, but waited %v since disconnecting %v ago", time.Since(reconnectedAt), stats.Waited, time.Since(disconnectedAt))
+	}
+
+	io.WriteString(wr, "2|B\n")
+	wr.Close()
+
+	for _, expected := range []string{"2|B\n", "3|B\n"} {
+		if got := string((<-payloadCh).Payload()); expected != got {
+			t.Errorf("handle.Stream => expected sequence to continue after reconnection, should have got %#q, but received %#q", expected, got)
+		}
+	}
+}
+
+func TestAppliesGracePolicy(t *testing.T) {
+	defer func(interval, gracePeriod time.Duration, grace handle.GracePolicy) {
+		handle.SkipCheckInterval, handle.GracePeriod, handle.Grace = interval, gracePeriod, grace
+	}(handle.SkipCheckInterval, handle.GracePeriod, handle.Grace)
+
+	handle.SkipCheckInterval = time.Millisecond
+	handle.GracePeriod = 10 * time.Millisecond
+
+	tests := []struct {
+		grace    handle.GracePolicy
+		input    []string
+		expected []string
+	}{
+		{
+			grace:    handle.FlushPolicy,
+			input:    []string{"1|B\n3|B\n", "4|B\n"},
+			expected: []string{"1|B\n", "3|B\n", "4|B\n"},
+		},
+		{
+			grace:    handle.DiscardPolicy,
+			input:    []string{"1|B\n3|B\n", "2|B\n"},
+			expected: []string{"1|B\n", "2|B\n"},
+		},
+	}
+
+	for _, testCase := range tests {
+		handle.Grace = testCase.grace
+
+		registryCh := client.NewRegistry()
+
+		payloadCh := make(chan client.Payloader, len(testCase.expected)+1)
+
+		registryCh <- client.RegisterFunc(12, payloadCh)
+
+		stream := handle.NewStream(registryCh)
+
+		for _, packets := range testCase.input {
+			stream.Source(source{strings.NewReader(packets)})
+
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		for _, expected := range testCase.expected {
+			if got := string((<-payloadCh).Payload()); expected != got {
+				t.Errorf("handle.Stream => with grace policy %v, should have got %#q, but received %#q", testCase.grace, expected, got)
+			}
+		}
+
+		select {
+		case pkt := <-payloadCh:
+			t.Errorf("handle.Stream => with grace policy %v, didn't expect %#q", testCase.grace, string(pkt.Payload()))
+		default:
+		}
+	}
+}
+
+func TestBuriesDiscardedPacketsWithArrivalTime(t *testing.T) {
+	defer func(interval, gracePeriod time.Duration, grace handle.GracePolicy, sink deadletter.Sink) {
+		handle.SkipCheckInterval, handle.GracePeriod, handle.Grace, handle.DeadLetter = interval, gracePeriod, grace, sink
+	}(handle.SkipCheckInterval, handle.GracePeriod, handle.Grace, handle.DeadLetter)
+
+	handle.SkipCheckInterval = time.Millisecond
+	handle.GracePeriod = 50 * time.Millisecond
+	handle.Grace = handle.DiscardPolicy
+
+	letterCh := make(chan deadletter.Letter, 1)
+
+	handle.DeadLetter = func(l deadletter.Letter) {
+		letterCh <- l
+	}
+
+	stream := handle.NewStream(client.NewRegistry())
+
+	sentAt := time.Now()
+
+	stream.Source(source{strings.NewReader("2|B\n")})
+
+	l := <-letterCh
+	buriedAt := time.Now()
+
+	if l.Reason != "discarded" {
+		t.Fatalf("handle.Stream => expected %#q to be discarded, got reason %q", l.Payload, l.Reason)
+	}
+
+	if l.ArrivedAt.Before(sentAt) || buriedAt.Sub(l.ArrivedAt) < handle.GracePeriod {
+		t.Errorf("handle.Stream => expected the arrival time of %#q, i.e. a grace period before it's buried at %v, got %v", l.Payload, buriedAt, l.ArrivedAt)
+	}
+}
@@ -0,0 +1,244 @@
+package handle
+
+import (
+	"fmt"
+	"time"
+
+	"../event"
+	"../log"
+)
+
+const (
+	// rateSmoothing is the weight of the latest sample
+	// in the exponentially weighted arrival rate.
+	rateSmoothing = 0.2
+
+	// packetOverhead is the approximate memory used by a buffered packet
+	// excluding its payload, i.e. map entry, packet struct and UIDs.
+	packetOverhead = 128
+)
+
+// OverflowPolicy denotes what to do with a packet that doesn't fit in the reorder window.
+type OverflowPolicy int
+
+const (
+	// BlockPolicy stops reading from the event source until the window advances.
+	// Only skipping a missing packet advances a full window, so with the Never
+	// skip policy a blocked source is never resumed.
+	BlockPolicy OverflowPolicy = iota
+
+	// AdvancePolicy skips the oldest missing packets until the packet fits.
+	AdvancePolicy
+
+	// RejectPolicy drops the packet.
+	RejectPolicy
+)
+
+// buffered is a packet kept in the window along with the time it arrived.
+// Forfeited sequence numbers are kept with a nil packet.
+type buffered struct {
+	pkt       event.Packet
+	arrivedAt time.Time
+}
+
+// window is a reorder buffer that is open on one end.
+// Packets are kept until every packet preceding them is released.
+type window struct {
+	index   uint64
+	maxSeen uint64
+
+	packets map[uint64]buffered
+	size    int
+
+	maxCount, maxSize int
+
+	arrivals     int
+	rate         float64
+	lastTick     time.Time
+	stalledSince time.Time
+}
+
+// newWindow creates a window that starts waiting from the given index.
+// A zero maxCount or maxSize means that the window is unbounded in that respect.
+func newWindow(index uint64, maxCount, maxSize int) *window {
+	now := time.Now()
+
+	return &window{
+		index:        index,
+		packets:      make(map[uint64]buffered),
+		maxCount:     maxCount,
+		maxSize:      maxSize,
+		lastTick:     now,
+		stalledSince: now,
+	}
+}
+
+// sizeOf returns the approximate memory a buffered packet occupies.
+func sizeOf(pkt event.Packet) int {
+	return len(pkt.Payload()) + packetOverhead
+}
+
+// fits reports whether the given packet can be inserted without exceeding
+// the window bounds. Packets that are released or ignored right away always fit.
+func (w *window) fits(pkt event.Packet) bool {
+	seq := pkt.Sequence()
+	if _, ok := w.packets[seq]; ok || seq <= w.index || len(w.packets) == 0 {
+		return true
+	}
+
+	if w.maxCount > 0 && len(w.packets)+1 > w.maxCount {
+		return false
+	}
+
+	if w.maxSize > 0 && w.size+sizeOf(pkt) > w.maxSize {
+		return false
+	}
+
+	return true
+}
+
+// insert buffers the given packet that arrived at the given time and reports
+// whether it was accepted. Packets with same sequence numbers or lower than
+// current index are ignored.
+func (w *window) insert(pkt event.Packet, arrivedAt time.Time) bool {
+	seq := pkt.Sequence()
+	if _, ok := w.packets[seq]; ok || seq < w.index {
+		return false
+	}
+
+	if len(w.packets) == 0 {
+		w.stalledSince = time.Now()
+	}
+
+	w.packets[seq] = buffered{pkt: pkt, arrivedAt: arrivedAt}
+	w.size += sizeOf(pkt)
+	w.arrivals++
+
+	if seq > w.maxSeen {
+		w.maxSeen = seq
+	}
+
+	return true
+}
+
+// ignores returns why a packet with the given sequence number would be
+// ignored by insert, i.e. "duplicate" or "late", or "" if it wouldn't.
+func (w *window) ignores(seq uint64) string {
+	if seq < w.index {
+		return "late"
+	}
+
+	if _, ok := w.packets[seq]; ok {
+		return "duplicate"
+	}
+
+	return ""
+}
+
+// forfeit marks the given sequence number as unusable, e.g. the packet was
+// malformed, so that the window doesn't wait for it.
+func (w *window) forfeit(seq uint64) bool {
+	if _, ok := w.packets[seq]; ok || seq < w.index {
+		return false
+	}
+
+	if len(w.packets) == 0 {
+		w.stalledSince = time.Now()
+	}
+
+	// Forfeited packets are kept as nil until they are released.
+	w.packets[seq] = buffered{}
+	w.arrivals++
+
+	if seq > w.maxSeen {
+		w.maxSeen = seq
+	}
+
+	return true
+}
+
+// release calls send for every packet in order until the next missing packet.
+func (w *window) release(send func(event.Packet)) {
+	advanced := false
+
+	for {
+		b, ok := w.packets[w.index]
+		if !ok {
+			break
+		}
+
+		if b.pkt != nil {
+			send(b.pkt)
+
+			w.size -= sizeOf(b.pkt)
+		}
+
+		// Evicts used event packets
+		// NOTE: Bulk delete might increase performance
+		delete(w.packets, w.index)
+
+		w.index++
+		advanced = true
+	}
+
+	if advanced {
+		w.stalledSince = time.Now()
+	}
+}
+
+// skip moves the index past the missing packets up to the lowest
+// buffered sequence number and returns the skipped range.
+func (w *window) skip() (from, to uint64) {
+	if len(w.packets) == 0 {
+		return w.index, w.index
+	}
+
+	lowest := w.maxSeen
+	for seq := range w.packets {
+		if seq < lowest {
+			lowest = seq
+		}
+	}
+
+	from, to = w.index, lowest
+	w.index = lowest
+
+	log.Info(fmt.Sprintf("handle.Events: skipped missing packets [%v, %v)", from, to))
+	counters.Add("skipped", int64(to-from))
+
+	return from, to
+}
+
+// discard drops every buffered packet and keeps waiting for the current index.
+func (w *window) discard() {
+	counters.Add("discarded", int64(len(w.packets)))
+
+	w.packets = make(map[uint64]buffered)
+	w.size = 0
+	w.maxSeen = w.index
+}
+
+// tick updates the arrival rate estimation.
+func (w *window) tick(now time.Time) {
+	elapsed := now.Sub(w.lastTick).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	sample := float64(w.arrivals) / elapsed
+	w.rate = rateSmoothing*sample + (1-rateSmoothing)*w.rate
+
+	w.arrivals = 0
+	w.lastTick = now
+}
+
+// stats returns a snapshot of the window state for skip policies.
+func (w *window) stats(now time.Time) Stats {
+	return Stats{
+		Index:    w.index,
+		MaxSeen:  w.maxSeen,
+		Buffered: len(w.packets),
+		Rate:     w.rate,
+		Waited:   now.Sub(w.stalledSince),
+	}
+}
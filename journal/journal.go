@@ -0,0 +1,475 @@
+// Package journal contains an append-only log of the events that are
+// released in order, split into segment files with size/age based
+// rotation and retention.
+//
+// Each segment is named after the sequence number of its first event
+// and contains the event payloads exactly as they were received.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../event"
+	"../log"
+)
+
+const (
+	segmentExt = ".log"
+)
+
+// OverflowPolicy denotes what Append does when the queue of the journal is full,
+// e.g. the disk can't keep up.
+type OverflowPolicy int
+
+const (
+	// BlockPolicy waits for room in the queue, which holds up the caller
+	// but keeps the journal complete. Stalls are counted.
+	BlockPolicy OverflowPolicy = iota
+
+	// DropPolicy drops the event, which leaves a gap in the journal.
+	DropPolicy
+)
+
+// counters keeps the journal statistics, e.g. number of dropped events.
+var counters = expvar.NewMap("journal")
+
+// Options contains the rotation, retention and sync settings of a Journal.
+// Zero values disable the respective behavior.
+type Options struct {
+	// SegmentSize is the size in bytes after which a new segment is started.
+	SegmentSize int64
+
+	// SegmentAge is the duration after which a new segment is started.
+	SegmentAge time.Duration
+
+	// MaxBytes is the total size of the segments that are retained.
+	MaxBytes int64
+
+	// MaxAge is the duration that a closed segment is retained.
+	MaxAge time.Duration
+
+	// SyncEvery fsyncs the active segment after every N events.
+	SyncEvery int
+
+	// SyncInterval fsyncs the active segment periodically.
+	SyncInterval time.Duration
+
+	// Buffer is the number of events that can be queued without blocking Append.
+	Buffer int
+
+	// Overflow decides what Append does once Buffer events are queued.
+	Overflow OverflowPolicy
+}
+
+// DefaultOptions are sensible settings for a Journal.
+var DefaultOptions = Options{
+	SegmentSize:  64 << 20,
+	SegmentAge:   time.Hour,
+	MaxBytes:     1 << 30,
+	MaxAge:       7 * 24 * time.Hour,
+	SyncInterval: time.Second,
+	Buffer:       4096,
+}
+
+// Journal is an append-only log that writes the events in a dedicated
+// goroutine, so that appending doesn't wait for disk writes. Segments are
+// fsynced in another goroutine, so that the writes keep draining the queue
+// into the page cache while the disk catches up.
+type Journal struct {
+	dir  string
+	opts Options
+
+	// mu guards pktCh against Append calls after Close.
+	mu       sync.RWMutex
+	isClosed bool
+
+	pktCh  chan event.Packet
+	doneCh chan error
+
+	segment   *os.File
+	writer    *bufio.Writer
+	size      int64
+	createdAt time.Time
+	unsynced  int
+
+	// syncMu guards the segments handed over to the syncing goroutine,
+	// the active segment to be synced and the closed ones to be synced and closed.
+	syncMu  sync.Mutex
+	dirty   *os.File
+	retired []*os.File
+	wakeCh  chan struct{}
+}
+
+// Open creates the given directory if necessary and starts a Journal that
+// writes new segments to it.
+func Open(dir string, opts Options) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		dir:    dir,
+		opts:   opts,
+		pktCh:  make(chan event.Packet, opts.Buffer),
+		doneCh: make(chan error, 1),
+		wakeCh: make(chan struct{}, 1),
+	}
+
+	syncDoneCh := make(chan error, 1)
+
+	go j.run(syncDoneCh)
+	go j.syncSegments(syncDoneCh)
+
+	return j, nil
+}
+
+// Append queues the given event to be written to the journal.
+// If the queue is full, the event is handled according to the overflow policy.
+// Events appended after Close are dropped.
+func (j *Journal) Append(pkt event.Packet) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	if j.isClosed {
+		counters.Add("dropped", 1)
+		return
+	}
+
+	select {
+	case j.pktCh <- pkt:
+		return
+	default:
+	}
+
+	if j.opts.Overflow == DropPolicy {
+		log.Debug(fmt.Sprintf("journal.Journal: queue is full, dropped packet %v", pkt.Sequence()))
+		counters.Add("dropped", 1)
+		return
+	}
+
+	start := time.Now()
+
+	j.pktCh <- pkt
+
+	stall := time.Since(start)
+
+	log.Debug(fmt.Sprintf("journal.Journal: queue is full, packet %v waited %v", pkt.Sequence(), stall))
+	counters.Add("stalls", 1)
+	counters.Add("stalled ms", int64(stall/time.Millisecond))
+}
+
+// Close writes the queued events, syncs and closes the active segment.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+
+	if j.isClosed {
+		j.mu.Unlock()
+		return nil
+	}
+
+	j.isClosed = true
+	close(j.pktCh)
+
+	j.mu.Unlock()
+
+	return <-j.doneCh
+}
+
+// run writes the queued events until the queue is closed, then waits for
+// the syncing goroutine to sync and close every segment.
+func (j *Journal) run(syncDoneCh <-chan error) {
+	var tickCh <-chan time.Time
+	if j.opts.SyncInterval > 0 {
+		ticker := time.NewTicker(j.opts.SyncInterval)
+		defer ticker.Stop()
+
+		tickCh = ticker.C
+	}
+
+	for {
+		select {
+		case pkt, ok := <-j.pktCh:
+			if !ok {
+				err := j.retire()
+
+				close(j.wakeCh)
+
+				if syncErr := <-syncDoneCh; err == nil {
+					err = syncErr
+				}
+
+				j.doneCh <- err
+				return
+			}
+
+			if err := j.write(pkt); err != nil {
+				log.Error(fmt.Sprintf("journal.Journal: while writing packet %v, got error %#q", pkt.Sequence(), err))
+				continue
+			}
+
+			if j.opts.SyncEvery > 0 && j.unsynced >= j.opts.SyncEvery {
+				j.sync()
+			} else if len(j.pktCh) == 0 {
+				// Writes the buffered events to the OS when the queue is drained.
+				j.writer.Flush()
+			}
+		case <-tickCh:
+			j.sync()
+		}
+	}
+}
+
+func (j *Journal) write(pkt event.Packet) error {
+	if j.segment == nil || j.isFull() {
+		if err := j.rotate(pkt.Sequence()); err != nil {
+			return err
+		}
+	}
+
+	n, err := j.writer.Write(pkt.Payload())
+
+	j.size += int64(n)
+	j.unsynced++
+
+	return err
+}
+
+func (j *Journal) isFull() bool {
+	if j.opts.SegmentSize > 0 && j.size >= j.opts.SegmentSize {
+		return true
+	}
+
+	return j.opts.SegmentAge > 0 && time.Since(j.createdAt) >= j.opts.SegmentAge
+}
+
+// sync writes the buffered events of the active segment
+// and hands it over to the syncing goroutine.
+func (j *Journal) sync() {
+	if j.segment == nil || j.unsynced == 0 {
+		return
+	}
+
+	if err := j.writer.Flush(); err != nil {
+		log.Error(fmt.Sprintf("journal.Journal: while flushing segment %#q, got error %#q", j.segment.Name(), err))
+		return
+	}
+
+	j.syncMu.Lock()
+	j.dirty = j.segment
+	j.syncMu.Unlock()
+
+	j.unsynced = 0
+	j.wake()
+}
+
+// retire writes the buffered events of the active segment and hands it
+// over to the syncing goroutine, which syncs and closes it.
+func (j *Journal) retire() error {
+	if j.segment == nil {
+		return nil
+	}
+
+	f, w := j.segment, j.writer
+	j.segment, j.writer, j.unsynced = nil, nil, 0
+
+	err := w.Flush()
+
+	j.syncMu.Lock()
+	if j.dirty == f {
+		j.dirty = nil
+	}
+
+	j.retired = append(j.retired, f)
+	j.syncMu.Unlock()
+
+	j.wake()
+
+	return err
+}
+
+// wake signals the syncing goroutine without waiting for it.
+func (j *Journal) wake() {
+	select {
+	case j.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// syncSegments syncs the segments handed over by the writing goroutine until
+// wakeCh is closed and reports the last error of closing a segment, if any.
+func (j *Journal) syncSegments(doneCh chan<- error) {
+	var err error
+
+	for range j.wakeCh {
+		if closeErr := j.syncPending(); closeErr != nil {
+			err = closeErr
+		}
+	}
+
+	if closeErr := j.syncPending(); closeErr != nil {
+		err = closeErr
+	}
+
+	doneCh <- err
+}
+
+// syncPending syncs the handed over segments and closes the retired ones.
+func (j *Journal) syncPending() error {
+	j.syncMu.Lock()
+	f, retired := j.dirty, j.retired
+	j.dirty, j.retired = nil, nil
+	j.syncMu.Unlock()
+
+	// Retired segments are only closed here, so f is still open.
+	if f != nil {
+		if err := f.Sync(); err != nil {
+			log.Error(fmt.Sprintf("journal.Journal: while syncing segment %#q, got error %#q", f.Name(), err))
+		}
+	}
+
+	var err error
+
+	for _, f := range retired {
+		if closeErr := closeSegment(f); closeErr != nil {
+			log.Error(fmt.Sprintf("journal.Journal: while closing segment %#q, got error %#q", f.Name(), closeErr))
+
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// rotate closes the active segment, applies the retention policy
+// and starts a new segment beginning with the given sequence number.
+func (j *Journal) rotate(seq uint64) error {
+	if err := j.retire(); err != nil {
+		log.Error(fmt.Sprintf("journal.Journal: while flushing segment, got error %#q", err))
+	}
+
+	j.retain()
+
+	f, err := os.OpenFile(filepath.Join(j.dir, segmentName(seq)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	j.segment, j.writer = f, bufio.NewWriter(f)
+	j.size, j.createdAt = 0, time.Now()
+
+	return nil
+}
+
+// closeSegment syncs and closes the given segment.
+func closeSegment(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// retain removes the oldest segments that exceed the retention limits.
+func (j *Journal) retain() {
+	segments, err := Segments(j.dir)
+	if err != nil {
+		log.Error(fmt.Sprintf("journal.Journal: while listing segments, got error %#q", err))
+		return
+	}
+
+	var total int64
+
+	infos := make([]os.FileInfo, len(segments))
+	for i, path := range segments {
+		if infos[i], err = os.Stat(path); err != nil {
+			return
+		}
+
+		total += infos[i].Size()
+	}
+
+	for i, path := range segments {
+		isTooLarge := j.opts.MaxBytes > 0 && total > j.opts.MaxBytes
+		isTooOld := j.opts.MaxAge > 0 && time.Since(infos[i].ModTime()) > j.opts.MaxAge
+
+		if !isTooLarge && !isTooOld {
+			break
+		}
+
+		if err := os.Remove(path); err != nil {
+			log.Error(fmt.Sprintf("journal.Journal: while removing segment %#q, got error %#q", path, err))
+			return
+		}
+
+		log.Debug(fmt.Sprintf("journal.Journal: removed segment %#q", path))
+
+		total -= infos[i].Size()
+	}
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%v", seq, segmentExt)
+}
+
+// Segments returns the paths of the segments in the given directory
+// in the order they are written.
+func Segments(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), segmentExt) {
+			segments = append(segments, filepath.Join(dir, f.Name()))
+		}
+	}
+
+	// Zero padded sequence numbers sort lexicographically.
+	sort.Strings(segments)
+
+	return segments, nil
+}
+
+// Replay calls fn for every event payload in the journal directory in order.
+func Replay(dir string, fn func(payload []byte) error) error {
+	segments, err := Segments(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range segments {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		for len(buf) > 0 {
+			i := bytes.IndexByte(buf, '\n')
+			if i < 0 {
+				// Ignores a partially written event at the end of a segment.
+				break
+			}
+
+			if err := fn(buf[:i+1]); err != nil {
+				return err
+			}
+
+			buf = buf[i+1:]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package journal_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"."
+	"../event"
+	"../testutil"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir got error %v", err)
+	}
+
+	return dir
+}
+
+func appendEvents(t *testing.T, j *journal.Journal, from, to int) []string {
+	var payloads []string
+
+	for seq := from; seq <= to; seq++ {
+		payload := fmt.Sprintf("%v|B\n", seq)
+
+		pkt, err := event.Parse([]byte(payload))
+		if err != nil {
+			t.Fatalf("event.Parse(%#q) got error %v", payload, err)
+		}
+
+		j.Append(pkt)
+
+		payloads = append(payloads, payload)
+	}
+
+	return payloads
+}
+
+func replay(t *testing.T, dir string) []string {
+	var payloads []string
+
+	err := journal.Replay(dir, func(payload []byte) error {
+		payloads = append(payloads, string(payload))
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("journal.Replay(%#q) got error %v", dir, err)
+	}
+
+	return payloads
+}
+
+func TestAppendsEventsInSegments(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := journal.Open(dir, journal.Options{
+		SegmentSize: 20,
+		SyncEvery:   2,
+	})
+	if err != nil {
+		t.Fatalf("journal.Open(%#q) got error %v", dir, err)
+	}
+
+	expected := appendEvents(t, j, 1, 20)
+
+	if err := j.Close(); err != nil {
+		t.Fatalf("journal.Close() got error %v", err)
+	}
+
+	if got := replay(t, dir); fmt.Sprint(expected) != fmt.Sprint(got) {
+		t.Errorf("journal.Replay(%#q) expected %#q, got %#q", dir, expected, got)
+	}
+
+	segments, err := journal.Segments(dir)
+	if err != nil {
+		t.Fatalf("journal.Segments(%#q) got error %v", dir, err)
+	}
+
+	// Segments are rotated once they reach 20 bytes, events below 10
+	// take 4 bytes and the rest take 5 bytes.
+	if expected, got := []string{"1", "6", "11", "15", "19"}, segments; len(expected) != len(got) {
+		t.Fatalf("journal.Segments(%#q) expected %v segments, got %v", dir, len(expected), got)
+	} else {
+		for i, seq := range expected {
+			if name := fmt.Sprintf("%020v.log", seq); filepath.Base(got[i]) != name {
+				t.Errorf("journal.Segments(%#q) expected segment %v to be %#q, got %#q", dir, i, name, filepath.Base(got[i]))
+			}
+		}
+	}
+}
+
+func TestRemovesSegmentsBeyondRetention(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := journal.Open(dir, journal.Options{
+		SegmentSize: 10,
+		MaxBytes:    20,
+	})
+	if err != nil {
+		t.Fatalf("journal.Open(%#q) got error %v", dir, err)
+	}
+
+	expected := appendEvents(t, j, 1, 9)
+
+	if err := j.Close(); err != nil {
+		t.Fatalf("journal.Close() got error %v", err)
+	}
+
+	// Retention is applied before a segment is started,
+	// so the oldest segments until the last two are removed.
+	if got := replay(t, dir); fmt.Sprint(expected[3:]) != fmt.Sprint(got) {
+		t.Errorf("journal.Replay(%#q) expected %#q, got %#q", dir, expected[3:], got)
+	}
+}
+
+func counter(name string) int64 {
+	return testutil.Counter("journal", name)
+}
+
+func TestDropsEventsWhenQueueIsFull(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := journal.Open(dir, journal.Options{
+		Buffer:   1,
+		Overflow: journal.DropPolicy,
+	})
+	if err != nil {
+		t.Fatalf("journal.Open(%#q) got error %v", dir, err)
+	}
+
+	dropped := counter("dropped")
+
+	appended := appendEvents(t, j, 1, 1000)
+
+	if err := j.Close(); err != nil {
+		t.Fatalf("journal.Close() got error %v", err)
+	}
+
+	dropped = counter("dropped") - dropped
+
+	// Every event is either written in order or dropped.
+	got := replay(t, dir)
+	if int64(len(got))+dropped != int64(len(appended)) {
+		t.Errorf("journal.Journal expected %v events to be written or dropped, got %v written and %v dropped", len(appended), len(got), dropped)
+	}
+
+	for i, next := 0, 0; i < len(got); i++ {
+		for next < len(appended) && appended[next] != got[i] {
+			next++
+		}
+
+		if next == len(appended) {
+			t.Fatalf("journal.Journal expected the written events to be in order, got %#q", got)
+		}
+	}
+}
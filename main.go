@@ -1,108 +1,488 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"./checkpoint"
 	"./client"
+	"./deadletter"
+	"./event"
 	"./handle"
+	"./journal"
 	"./log"
 	"./protocol"
+	"./proxy"
 	"./server"
 )
 
 var (
 	registryChan = client.NewRegistry()
+
+	// closers are closed once before the server exits, e.g. to flush the journal.
+	closers   []io.Closer
+	closeOnce sync.Once
 )
 
 var (
 	ClientListenerPort = os.Getenv("clientListenerPort")
 	EventListenerPort  = os.Getenv("eventListenerPort")
+
+	EventSocket     = os.Getenv("eventSocket")
+	EventSocketPerm = os.Getenv("eventSocketPerm")
+
+	EventTLSListenerPort  = os.Getenv("eventTLSListenerPort")
+	ClientTLSListenerPort = os.Getenv("clientTLSListenerPort")
+	TLSCert               = os.Getenv("tlsCert")
+	TLSKey                = os.Getenv("tlsKey")
+	TLSClientCA           = os.Getenv("tlsClientCA")
+	Identity              = os.Getenv("identity")
+
+	ClientWebSocketPort    = os.Getenv("clientWebSocketPort")
+	ClientWebSocketPath    = os.Getenv("clientWebSocketPath")
+	ClientWebSocketOrigins = os.Getenv("clientWebSocketOrigins")
+
+	CheckpointFile     = os.Getenv("checkpointFile")
+	CheckpointInterval = os.Getenv("checkpointInterval")
+
+	StrictCRLF = os.Getenv("strictCRLF")
+
+	HandshakeTimeout = os.Getenv("handshakeTimeout")
+	WriteTimeout     = os.Getenv("writeTimeout")
+
+	QueueSize    = os.Getenv("queueSize")
+	SlowConsumer = os.Getenv("slowConsumer")
+
+	MaxWindow      = os.Getenv("maxWindow")
+	MaxWindowBytes = os.Getenv("maxWindowBytes")
+	WindowOverflow = os.Getenv("windowOverflow")
+	SkipMinWait    = os.Getenv("skipMinWait")
+	SkipMaxWait    = os.Getenv("skipMaxWait")
+	GracePeriod    = os.Getenv("gracePeriod")
+	Grace          = os.Getenv("grace")
+
+	UIDMode       = os.Getenv("uidMode")
+	MaxUIDLength  = os.Getenv("maxUIDLength")
+	MaxStringUIDs = os.Getenv("maxStringUIDs")
+
+	JournalDir          = os.Getenv("journalDir")
+	JournalSyncEvery    = os.Getenv("journalSyncEvery")
+	JournalSyncInterval = os.Getenv("journalSyncInterval")
+	JournalOverflow     = os.Getenv("journalOverflow")
+
+	UpstreamAddrs = os.Getenv("upstreamAddrs")
+	ProxyReorder  = os.Getenv("proxyReorder")
+	ProxyOverflow = os.Getenv("proxyOverflow")
+
+	AdminListenerPort = os.Getenv("adminListenerPort")
+	DeadLetterFile    = os.Getenv("deadLetterFile")
+	DeadLetterPort    = os.Getenv("deadLetterPort")
 )
 
+// Parses an integer environment variable, exits if it is malformed.
+func parseEnv(name, value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatal(fmt.Errorf("environment variable %v=%#q is not a number", name, value))
+	}
+
+	return n
+}
+
 func init() {
-	if EventListenerPort != "" {
-		EventListenerPort = ":" + EventListenerPort
-	} else {
-		EventListenerPort = ":9090"
+	if EventListenerPort == "" {
+		EventListenerPort = "9090"
 	}
 
-	if ClientListenerPort != "" {
-		ClientListenerPort = ":" + ClientListenerPort
-	} else {
-		ClientListenerPort = ":9099"
+	if ClientListenerPort == "" {
+		ClientListenerPort = "9099"
+	}
+
+	event.StrictCRLF = StrictCRLF == "true"
+
+	switch UIDMode {
+	case "", "numeric":
+	case "string":
+		client.Mode = client.StringUIDs
+	default:
+		log.Fatal(fmt.Errorf("environment variable uidMode=%#q should be either numeric or string", UIDMode))
+	}
+
+	switch Identity {
+	case "", "ignore":
+	case "verify":
+		handle.Identity = handle.VerifyIdentity
+	case "trust":
+		handle.Identity = handle.TrustIdentity
+	default:
+		log.Fatal(fmt.Errorf("environment variable identity=%#q should be one of ignore, verify or trust", Identity))
+	}
+
+	if handle.Identity != handle.IgnoreIdentity && TLSClientCA == "" {
+		log.Fatal(fmt.Errorf("environment variable identity=%#q requires tlsClientCA to authenticate user clients", Identity))
+	}
+
+	if HandshakeTimeout != "" {
+		handle.HandshakeTimeout = time.Duration(parseEnv("handshakeTimeout", HandshakeTimeout)) * time.Millisecond
+	}
+
+	if WriteTimeout != "" {
+		handle.WriteTimeout = time.Duration(parseEnv("writeTimeout", WriteTimeout)) * time.Millisecond
+	}
+
+	if QueueSize != "" {
+		client.QueueSize = parseEnv("queueSize", QueueSize)
+	}
+
+	switch SlowConsumer {
+	case "", "disconnect":
+	case "drop-newest":
+		client.SlowConsumer = client.DropNewestPolicy
+	case "drop-oldest":
+		client.SlowConsumer = client.DropOldestPolicy
+	default:
+		log.Fatal(fmt.Errorf("environment variable slowConsumer=%#q should be one of disconnect, drop-newest or drop-oldest", SlowConsumer))
+	}
+
+	if MaxWindow != "" {
+		handle.MaxWindow = parseEnv("maxWindow", MaxWindow)
+	}
+
+	if MaxWindowBytes != "" {
+		handle.MaxWindowBytes = parseEnv("maxWindowBytes", MaxWindowBytes)
+	}
+
+	switch WindowOverflow {
+	case "", "advance":
+	case "block":
+		handle.Overflow = handle.BlockPolicy
+	case "reject":
+		handle.Overflow = handle.RejectPolicy
+	default:
+		log.Fatal(fmt.Errorf("environment variable windowOverflow=%#q should be one of advance, block or reject", WindowOverflow))
 	}
+
+	if SkipMinWait != "" || SkipMaxWait != "" {
+		min, max := time.Second, 10*time.Second
+
+		if SkipMinWait != "" {
+			min = time.Duration(parseEnv("skipMinWait", SkipMinWait)) * time.Millisecond
+		}
+
+		if SkipMaxWait != "" {
+			max = time.Duration(parseEnv("skipMaxWait", SkipMaxWait)) * time.Millisecond
+		}
+
+		if min > max {
+			log.Fatal(fmt.Errorf("environment variable skipMinWait=%#q should be at most skipMaxWait=%#q", SkipMinWait, SkipMaxWait))
+		}
+
+		handle.Skip = handle.Greedy(min, max)
+	}
+
+	if GracePeriod != "" {
+		handle.GracePeriod = time.Duration(parseEnv("gracePeriod", GracePeriod)) * time.Millisecond
+	}
+
+	switch Grace {
+	case "", "flush":
+	case "discard":
+		handle.Grace = handle.DiscardPolicy
+	default:
+		log.Fatal(fmt.Errorf("environment variable grace=%#q should be either flush or discard", Grace))
+	}
+
+	if MaxUIDLength != "" {
+		client.MaxUIDLength = parseEnv("maxUIDLength", MaxUIDLength)
+	}
+
+	if MaxStringUIDs != "" {
+		client.MaxStringUIDs = parseEnv("maxStringUIDs", MaxStringUIDs)
+	}
+
+	if CheckpointInterval != "" {
+		handle.CheckpointInterval = time.Duration(parseEnv("checkpointInterval", CheckpointInterval)) * time.Millisecond
+	}
+}
+
+// Creates a listener with listen for each comma separated port, a port may be
+// prefixed with a host to listen on a single interface, e.g. `9090,10.0.0.1:9091`.
+func listenersOn(ports string, listen func(addr string) protocol.Listener) []protocol.Listener {
+	var listeners []protocol.Listener
+
+	for _, port := range strings.Split(ports, ",") {
+		if !strings.Contains(port, ":") {
+			port = ":" + port
+		}
+
+		listeners = append(listeners, listen(port))
+	}
+
+	return listeners
 }
 
-// Handles event sources and supports multiple event sources at the same time.
-func handleEventSourceConnections(conn client.Interface) error {
-	rdr := bufio.NewReader(conn)
+// Creates a TCP listener for each comma separated port.
+func tcpListeners(ports string) []protocol.Listener {
+	return listenersOn(ports, protocol.TCP)
+}
 
-	payloadCh := make(chan []byte)
-	defer close(payloadCh)
+// Creates a TLS listener for each comma separated port.
+func tlsListeners(ports string) []protocol.Listener {
+	return listenersOn(ports, func(addr string) protocol.Listener {
+		return protocol.TLS(addr, TLSCert, TLSKey, TLSClientCA)
+	})
+}
 
-	handle.Events(payloadCh, registryChan)
+// Appends every event released in order to the journal in the given directory.
+func setupJournal(dir string) {
+	opts := journal.DefaultOptions
 
-	for {
-		payload, err := rdr.ReadBytes('\n')
-		if err != nil {
-			if err != io.EOF {
-				log.Error(fmt.Sprintf("server.Listen: event source thrown read error %#q", err))
+	if JournalSyncEvery != "" {
+		opts.SyncEvery = parseEnv("journalSyncEvery", JournalSyncEvery)
+	}
+
+	if JournalSyncInterval != "" {
+		opts.SyncInterval = time.Duration(parseEnv("journalSyncInterval", JournalSyncInterval)) * time.Millisecond
+	}
+
+	switch JournalOverflow {
+	case "", "block":
+	case "drop":
+		opts.Overflow = journal.DropPolicy
+	default:
+		log.Fatal(fmt.Errorf("environment variable journalOverflow=%#q should be one of block or drop", JournalOverflow))
+	}
+
+	j, err := journal.Open(dir, opts)
+	if err != nil {
+		log.Fatal(fmt.Errorf("while opening journal %#q, got error %v", dir, err))
+	}
+
+	closers = append(closers, j)
+
+	handle.OnRelease = j.Append
+}
+
+// Closes the closers and exits with the given error, if any.
+func exit(err error) {
+	closeOnce.Do(func() {
+		for _, c := range closers {
+			if cerr := c.Close(); cerr != nil {
+				log.Error(fmt.Sprintf("while shutting down, got error %#q", cerr))
 			}
+		}
+	})
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Exit(0)
+}
+
+// Connects to every comma separated upstream address and forwards the ordered
+// stream to them. If reordering is disabled, it returns a protocol.Handler that
+// relays the valid events of the event sources as they arrive instead.
+func setupProxy(addrs string) protocol.Handler {
+	switch ProxyOverflow {
+	case "", "drop":
+	case "disconnect":
+		proxy.Overflow = proxy.DisconnectPolicy
+	default:
+		log.Fatal(fmt.Errorf("environment variable proxyOverflow=%#q should be one of drop or disconnect", ProxyOverflow))
+	}
 
-			break
+	var upstreams []*proxy.Upstream
+	for _, addr := range strings.Split(addrs, ",") {
+		upstreams = append(upstreams, proxy.NewUpstream(addr))
+	}
+
+	if ProxyReorder == "false" {
+		return proxy.Relay(upstreams...)
+	}
+
+	forward := proxy.Forward(upstreams...)
+
+	if onRelease := handle.OnRelease; onRelease != nil {
+		handle.OnRelease = func(pkt event.Packet) {
+			onRelease(pkt)
+			forward(pkt)
 		}
+	} else {
+		handle.OnRelease = forward
+	}
+
+	return nil
+}
 
-		// No more to read close the loop
-		if len(payload) == 0 {
-			break
+// Routes the thrown away events to an in-memory ring exposed on the admin port
+// and to the dead-letter file and consumers if they are configured.
+func setupDeadLetters() {
+	ring := deadletter.NewRing(1024)
+	ring.Publish("deadletters")
+
+	sinks := []deadletter.Sink{ring.Put}
+
+	if DeadLetterFile != "" {
+		sink, err := deadletter.File(DeadLetterFile, 1024)
+		if err != nil {
+			log.Fatal(fmt.Errorf("while opening dead-letter file %#q, got error %v", DeadLetterFile, err))
 		}
 
-		payloadCh <- payload
+		sinks = append(sinks, sink)
 	}
 
-	return nil
+	if DeadLetterPort != "" {
+		log.Info("Starting the dead-letter consumer handler...")
+		sinks = append(sinks, deadletter.TCP(protocol.TCP(":"+DeadLetterPort), 1024))
+	}
+
+	handle.DeadLetter = deadletter.Tee(sinks...)
+
+	if AdminListenerPort != "" {
+		go func() {
+			log.Info("Starting the admin handler...")
+
+			// expvar serves the counters and the dead letters on /debug/vars.
+			if err := http.ListenAndServe(":"+AdminListenerPort, nil); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 }
 
-// Handles new event consumer connections.
-func handleClientConnections(conn client.Interface) error {
-	rdr := bufio.NewReader(conn)
+// Restores the delivery progress and the follow graph from the checkpoint
+// file if there is one and enables periodic checkpoints.
+func setupCheckpoints(path string) {
+	state, err := checkpoint.Load(path)
+	switch {
+	case err == nil:
+		log.Info(fmt.Sprintf("Restored checkpoint %#q, continuing from packet %v", path, state.Index))
 
-	// Trims the line-feed at the end
-	buf, _, err := rdr.ReadLine()
-	if err != nil {
-		return err
+		registryChan <- checkpoint.RestoreFunc(state)
+
+		handle.StartingIndex = state.Index
+	case os.IsNotExist(err):
+	default:
+		log.Fatal(fmt.Errorf("while loading checkpoint %#q, got error %v", path, err))
 	}
 
-	uid, err := client.ParseUID(buf)
+	stateCh := checkpoint.Writer(path)
+
+	handle.Checkpoint = func(index uint64) client.RegistryFunc {
+		return checkpoint.SnapshotFunc(index, stateCh)
+	}
+}
+
+// Handles new event consumer connections.
+func handleClientConnections(conn client.Interface) error {
+	h, err := handle.Handshake(conn)
 	if err != nil {
 		return err
 	}
 
 	payloadCh := make(chan client.Payloader)
 
-	handle.Client(conn, payloadCh)
+	doneCh := handle.Client(conn, payloadCh)
 
 	// Sends a closure that registers client to the client registry.
-	registryChan <- client.RegisterFunc(client.UID(uid), payloadCh)
+	if h.Resume {
+		registryChan <- client.ResumeFunc(h.UID, payloadCh, h.Since)
+	} else {
+		registryChan <- client.RegisterFunc(h.UID, payloadCh)
+	}
+
+	// Detaches the connection once it ends, the session keeps its followers.
+	<-doneCh
+
+	registryChan <- client.DisconnectFunc(h.UID, payloadCh)
 
 	return nil
 }
 
 func main() {
 	go func() {
-		log.Info("Starting the event source handler...")
-		err := server.Listen(protocol.TCP(EventListenerPort), handleEventSourceConnections)
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+		log.Info(fmt.Sprintf("Received %v, shutting down...", <-sigCh))
+
+		exit(nil)
+	}()
+
+	if CheckpointFile != "" {
+		setupCheckpoints(CheckpointFile)
+	}
+
+	if JournalDir != "" {
+		setupJournal(JournalDir)
+	}
+
+	setupDeadLetters()
+
+	var handleEventSources protocol.Handler
+
+	if UpstreamAddrs != "" {
+		handleEventSources = setupProxy(UpstreamAddrs)
+	}
+
+	if handleEventSources == nil {
+		// Every event source connection feeds into the same stream.
+		handleEventSources = handle.NewStream(registryChan).Source
+	}
+
+	eventListeners := tcpListeners(EventListenerPort)
+	if EventTLSListenerPort != "" {
+		eventListeners = append(eventListeners, tlsListeners(EventTLSListenerPort)...)
+	}
+
+	if EventSocket != "" {
+		perm, err := strconv.ParseUint(EventSocketPerm, 8, 32)
+		if EventSocketPerm == "" {
+			perm, err = 0660, nil
+		}
+
 		if err != nil {
-			log.Fatal(err)
+			log.Fatal(fmt.Errorf("environment variable eventSocketPerm=%#q is not an octal number", EventSocketPerm))
+		}
+
+		eventListeners = append(eventListeners, protocol.Unix(EventSocket, os.FileMode(perm)))
+	}
+
+	clientListeners := tcpListeners(ClientListenerPort)
+	if ClientTLSListenerPort != "" {
+		clientListeners = append(clientListeners, tlsListeners(ClientTLSListenerPort)...)
+	}
+
+	if ClientWebSocketPort != "" {
+		path := ClientWebSocketPath
+		if path == "" {
+			path = "/"
 		}
+
+		var origins []string
+		if ClientWebSocketOrigins != "" {
+			origins = strings.Split(ClientWebSocketOrigins, ",")
+		}
+
+		clientListeners = append(clientListeners, listenersOn(ClientWebSocketPort, func(addr string) protocol.Listener {
+			return protocol.WebSocket(addr, path, origins...)
+		})...)
+	}
+
+	go func() {
+		log.Info("Starting the event source handler...")
+		exit(server.ListenAll(handleEventSources, eventListeners...))
 	}()
 
 	log.Info("Starting the client handler...")
-	err := server.Listen(protocol.TCP(ClientListenerPort), handleClientConnections)
-	if err != nil {
-		log.Fatal(err)
-	}
+	exit(server.ListenAll(handleClientConnections, clientListeners...))
 }
@@ -3,6 +3,7 @@ package notify
 
 import (
 	"fmt"
+	"sync"
 
 	"../client"
 	"../event"
@@ -13,25 +14,71 @@ import (
 // takes a client.Registry and modifies it.
 type Func func(pkt event.Packet) client.RegistryFunc
 
-var notifyMap = map[event.Action]Func{
-	event.FollowAction:         Follow,
-	event.UnfollowAction:       Unfollow,
-	event.PrivateMessageAction: PrivateMessage,
-	event.StatusUpdateAction:   StatusUpdate,
-	event.BroadcastAction:      Broadcast,
+var (
+	// mu guards notifyMap, which is modified only by Register and Unregister.
+	mu sync.RWMutex
+
+	notifyMap = map[event.Action]Func{
+		event.FollowAction:         Follow,
+		event.UnfollowAction:       Unfollow,
+		event.PrivateMessageAction: PrivateMessage,
+		event.StatusUpdateAction:   StatusUpdate,
+		event.BroadcastAction:      Broadcast,
+	}
+)
+
+// Register declares a new action with the given code and field layout
+// using event.Register and makes FuncFor use the given Func for its packets.
+// It is meant to be called before any packets are parsed, e.g. from init.
+func Register(code string, layout event.Layout, fn Func) (event.Action, error) {
+	action, err := event.Register(code, layout)
+	if err != nil {
+		return 0, err
+	}
+
+	mu.Lock()
+	notifyMap[action] = fn
+	mu.Unlock()
+
+	return action, nil
+}
+
+// Unregister removes an action declared with Register using event.Unregister,
+// e.g. to clean up in tests.
+func Unregister(action event.Action) error {
+	if err := event.Unregister(action); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	delete(notifyMap, action)
+	mu.Unlock()
+
+	return nil
 }
 
-// New returns a notification closure for the
+// FuncFor returns a notification closure for the
 // given event.Packet.
 func FuncFor(pkt event.Packet) client.RegistryFunc {
-	return notifyMap[pkt.Action()](pkt)
+	mu.RLock()
+	fn, ok := notifyMap[pkt.Action()]
+	mu.RUnlock()
+
+	if !ok {
+		return func(client.Registry) error {
+			return fmt.Errorf("for packet numbered %v action %v has no notification", pkt.Sequence(), pkt.Action())
+		}
+	}
+
+	return fn(pkt)
 }
 
 // Follow returns a closure that adds a follower
 // to the target user's list and sends a notification to that user when invoked.
 // If the target user hasn't connected to the client.Registry yet,
 // it registers that user into the client.Registry, but as inactive
-// so that a list of followers can be kept
+// so that a list of followers can be kept and the notification
+// is kept in the inbox of that user
 func Follow(pkt event.Packet) client.RegistryFunc {
 	return func(clients client.Registry) error {
 		UIDs := pkt.UIDs()
@@ -49,7 +96,7 @@ func Follow(pkt event.Packet) client.RegistryFunc {
 		targetClient := clients[to]
 		targetClient.Followers.Add(from)
 
-		if err := targetClient.Send(pkt); err != nil {
+		if err := targetClient.SendOrStore(pkt); err != nil {
 			log.Debug(fmt.Sprintf("notify.Follow: for client %v, got error %#q", to, err))
 			client.UnregisterFunc(to)(clients)
 			return err
@@ -68,7 +115,7 @@ func Unfollow(pkt event.Packet) client.RegistryFunc {
 		from, to := UIDs[0], UIDs[1]
 
 		if _, ok := clients[to]; !ok {
-			return fmt.Errorf("for packet numbered %v client %#q is not connected", pkt.Sequence(), to)
+			return fmt.Errorf("for packet numbered %v client %v is not connected", pkt.Sequence(), to)
 		}
 
 		targetClient := clients[to]
@@ -101,10 +148,8 @@ func StatusUpdate(pkt event.Packet) client.RegistryFunc {
 				continue
 			}
 
-			if !follower.IsActive() {
-				continue
-			}
-
+			// Inactive followers aren't notified, but the notification
+			// is kept in their history in case they resume.
 			if err := follower.Send(pkt); err != nil {
 				log.Debug(fmt.Sprintf("notify.StatusUpdate: for client %v, got error %#q", uid, err))
 				delete(targetClient.Followers, uid)
@@ -119,6 +164,7 @@ func StatusUpdate(pkt event.Packet) client.RegistryFunc {
 
 // PrivateMessage returns a closure that sends a private message
 // notification to the target user when invoked.
+// If the target user is inactive, the notification is kept in its inbox.
 func PrivateMessage(pkt event.Packet) client.RegistryFunc {
 	return func(clients client.Registry) error {
 		to := pkt.UIDs()[1]
@@ -129,7 +175,7 @@ func PrivateMessage(pkt event.Packet) client.RegistryFunc {
 
 		targetClient := clients[to]
 
-		if err := targetClient.Send(pkt); err != nil {
+		if err := targetClient.SendOrStore(pkt); err != nil {
 			log.Debug(fmt.Sprintf("notify.PrivateMessage: for client %v, got error %#q", to, err))
 			client.UnregisterFunc(to)(clients)
 			return err
@@ -224,3 +224,61 @@ func TestSendsStatusUpdateToAllFollowers(t *testing.T) {
 	default:
 	}
 }
+
+func TestKeepsPrivateMessagesForInactiveTargets(t *testing.T) {
+	registryCh, _ := populateClientRegistry()
+	defer close(registryCh)
+
+	to := client.UID(15)
+
+	registryCh <- func(r client.Registry) error {
+		return r[to].Close()
+	}
+
+	payload := []byte("123123|P|2|15\n")
+	pkt, err := event.Parse(payload)
+	if err != nil {
+		t.Fatalf("parse.Event(%#q) got error %v", string(payload), err)
+	}
+
+	registryCh <- notify.FuncFor(pkt)
+
+	payloadCh := make(chan client.Payloader, 1)
+
+	registryCh <- client.RegisterFunc(to, payloadCh)
+
+	if got := (<-payloadCh).Payload(); string(got) != string(payload) {
+		t.Errorf("notify.PrivateMessage => expected user %v to receive %#q after registering, but it received %#q", to, string(payload), string(got))
+	}
+}
+
+func TestNotifiesRegisteredActions(t *testing.T) {
+	registryCh, payloadCh := populateClientRegistry()
+	defer close(registryCh)
+	defer close(payloadCh)
+
+	// Notifies the mentioned user.
+	mention := func(pkt event.Packet) client.RegistryFunc {
+		return func(clients client.Registry) error {
+			return clients[pkt.UIDs()[1]].Send(pkt)
+		}
+	}
+
+	action, err := notify.Register("M", event.Layout{UIDs: 2, Body: true}, mention)
+	if err != nil {
+		t.Fatalf("notify.Register(%#q) got error %v", "M", err)
+	}
+	defer notify.Unregister(action)
+
+	payload := []byte("123123|M|15|2|hello\n")
+	pkt, err := event.Parse(payload)
+	if err != nil {
+		t.Fatalf("parse.Event(%#q) got error %v", string(payload), err)
+	}
+
+	registryCh <- notify.FuncFor(pkt)
+
+	if got := (<-payloadCh).Payload(); string(got) != string(payload) {
+		t.Errorf("notify.FuncFor => expected registered action to notify user %v with %#q, but it received %#q", 2, string(payload), string(got))
+	}
+}
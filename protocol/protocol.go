@@ -32,6 +32,12 @@ func TCP(addr string) Listener {
 		panic(err)
 	}
 
+	return TCPOn(listener)
+}
+
+// TCPOn creates a listener that accepts TCP connections from the given
+// bound listener, e.g. one bound to an ephemeral port.
+func TCPOn(listener net.Listener) Listener {
 	// Sets options for TCP socket connections
 	// TODO(tmrts); Optimize heartbeat pings
 	setOptions := func(conn net.Conn) error {
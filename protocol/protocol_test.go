@@ -10,8 +10,14 @@ import (
 )
 
 func TestAcceptsTCPConnections(t *testing.T) {
-	addr := ":9229"
-	accept := protocol.TCP(addr)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen got error %v", err)
+	}
+	defer l.Close()
+
+	addr := l.Addr().String()
+	accept := protocol.TCPOn(l)
 
 	pingMsg, pongMsg := "Hello, World!\n", "!dlroW, olleH\n"
 	msgChan := make(chan string, 1)
@@ -19,7 +25,8 @@ func TestAcceptsTCPConnections(t *testing.T) {
 	go func() {
 		conn, err := accept()
 		if err != nil {
-			t.Fatalf("protocol.TCP(%#q) got error %v", addr, err)
+			t.Errorf("protocol.TCP(%#q) got error %v", addr, err)
+			return
 		}
 
 		defer conn.Close()
@@ -27,13 +34,14 @@ func TestAcceptsTCPConnections(t *testing.T) {
 		rdr := bufio.NewReader(conn)
 		buf, err := rdr.ReadBytes('\n')
 		if err != nil {
-			t.Fatalf("bufio.ReadBytes(conn) got error %v", err)
+			t.Errorf("bufio.ReadBytes(conn) got error %v", err)
+			return
 		}
 
 		msgChan <- string(buf)
 
 		if _, err := io.WriteString(conn, pongMsg); err != nil {
-			t.Fatalf("bufio.Write(conn, %#q) got error %v", pongMsg, err)
+			t.Errorf("bufio.Write(conn, %#q) got error %v", pongMsg, err)
 		}
 	}()
 
@@ -49,7 +57,7 @@ func TestAcceptsTCPConnections(t *testing.T) {
 	}
 
 	if expected, got := pingMsg, <-msgChan; got != expected {
-		t.Errorf("io.WriteString(conn, %#q) client received %#q instead of %#q", expected, got)
+		t.Errorf("io.WriteString(conn, %#q) client received %#q", expected, got)
 	}
 
 	rdr := bufio.NewReader(conn)
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"../client"
+	"../log"
+)
+
+var IncorrectCAError = errors.New("client CA file doesn't contain any certificates")
+
+// TLS creates a listener on the given address that accepts TLS connections
+// using the given certificate and key files. If a client CA file is given,
+// clients have to present a certificate signed by it, i.e. mutual TLS, and
+// the accepted connections report the subject of the certificate with Identity.
+// Throws a panic if loading the files or binding is unsuccessful.
+func TLS(addr, certFile, keyFile, clientCAFile string) Listener {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error(fmt.Sprintf("while binding to address %#q, got error %#q", addr, err))
+		panic(err)
+	}
+
+	return TLSOn(listener, certFile, keyFile, clientCAFile)
+}
+
+// TLSOn creates a listener like TLS that accepts connections from the given
+// bound listener, e.g. one bound to an ephemeral port.
+// Throws a panic if loading the files is unsuccessful.
+func TLSOn(listener net.Listener, certFile, keyFile, clientCAFile string) Listener {
+	config, err := tlsConfig(certFile, keyFile, clientCAFile)
+	if err != nil {
+		log.Error(fmt.Sprintf("while loading TLS configuration for address %#q, got error %#q", listener.Addr(), err))
+		panic(err)
+	}
+
+	accept := TCPOn(listener)
+
+	return func() (client.Interface, error) {
+		conn, err := accept()
+		if err != nil {
+			return nil, err
+		}
+
+		return TLSConn{tls.Server(conn.(net.Conn), config)}, nil
+	}
+}
+
+// tlsConfig creates a server configuration from the given files.
+func tlsConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	buf, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, IncorrectCAError
+	}
+
+	config.ClientCAs, config.ClientAuth = pool, tls.RequireAndVerifyClientCert
+
+	return config, nil
+}
+
+// TLSConn is a connection accepted by a TLS listener.
+type TLSConn struct {
+	*tls.Conn
+}
+
+// Identity returns the subject common name of the verified client certificate,
+// completing the TLS handshake if necessary. It reports false if the client
+// didn't present a verified certificate or the handshake failed.
+func (c TLSConn) Identity() (string, bool) {
+	if err := c.Handshake(); err != nil {
+		log.Debug(fmt.Sprintf("protocol.TLSConn: handshake failed with error %#q", err))
+		return "", false
+	}
+
+	chains := c.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", false
+	}
+
+	return chains[0][0].Subject.CommonName, true
+}
@@ -0,0 +1,185 @@
+package protocol_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"."
+)
+
+// certificate is a key pair signed by its issuer, or by itself if it has none.
+type certificate struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+func newCertificate(t *testing.T, cn string, issuer *certificate) *certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey got error %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	parent, signer := template, key
+	if issuer == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		parent, signer = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(%#q) got error %v", cn, err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(%#q) got error %v", cn, err)
+	}
+
+	return &certificate{cert, der, key}
+}
+
+// save writes the certificate and its key in PEM format to the given directory.
+func (c *certificate) save(t *testing.T, dir, name string) (certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey got error %v", err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestAcceptsMutualTLSConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newCertificate(t, "event-queue CA", nil)
+	caFile, _ := ca.save(t, dir, "ca")
+
+	certFile, keyFile := newCertificate(t, "127.0.0.1", ca).save(t, dir, "server")
+
+	user := newCertificate(t, "2932", ca)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen got error %v", err)
+	}
+	defer l.Close()
+
+	addr := l.Addr().String()
+	accept := protocol.TLSOn(l, certFile, keyFile, caFile)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	go func() {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			RootCAs: pool,
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{user.der},
+				PrivateKey:  user.key,
+			}},
+		})
+		if err != nil {
+			t.Errorf("tls.Dial(%#q) got error %v", addr, err)
+			return
+		}
+		defer conn.Close()
+
+		io.WriteString(conn, "2932\r\n")
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	conn, err := accept()
+	if err != nil {
+		t.Fatalf("protocol.TLS(%#q) got error %v", addr, err)
+	}
+	defer conn.Close()
+
+	identity, ok := conn.(protocol.TLSConn).Identity()
+	if !ok || identity != "2932" {
+		t.Errorf("protocol.TLSConn.Identity() expected %#q, got %#q and %v", "2932", identity, ok)
+	}
+
+	buf := make([]byte, len("2932\r\n"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "2932\r\n" {
+		t.Errorf("protocol.TLS(%#q) expected to read %#q, got %#q and error %v", addr, "2932\r\n", buf, err)
+	}
+}
+
+func TestRejectsClientsWithoutCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newCertificate(t, "event-queue CA", nil)
+	caFile, _ := ca.save(t, dir, "ca")
+
+	certFile, keyFile := newCertificate(t, "127.0.0.1", ca).save(t, dir, "server")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen got error %v", err)
+	}
+	defer l.Close()
+
+	addr := l.Addr().String()
+	accept := protocol.TLSOn(l, certFile, keyFile, caFile)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	go func() {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	conn, err := accept()
+	if err != nil {
+		t.Fatalf("protocol.TLS(%#q) got error %v", addr, err)
+	}
+	defer conn.Close()
+
+	if identity, ok := conn.(protocol.TLSConn).Identity(); ok {
+		t.Errorf("protocol.TLSConn.Identity() expected no identity without a client certificate, got %#q", identity)
+	}
+}
@@ -0,0 +1,103 @@
+//go:build unix
+
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"../client"
+	"../log"
+)
+
+var (
+	SocketInUseError = errors.New("another process is listening on the socket")
+	NotASocketError  = errors.New("file exists and isn't a socket")
+)
+
+// Unix creates a listener on the socket file at the given path that accepts
+// Unix domain stream connections. The socket file gets the given permissions.
+// A stale socket file left behind by a previous process is removed first.
+// Throws a panic if binding is unsuccessful.
+func Unix(path string, perm os.FileMode) Listener {
+	if err := removeStaleSocket(path); err != nil {
+		log.Error(fmt.Sprintf("while binding to socket %#q, got error %#q", path, err))
+		panic(err)
+	}
+
+	listener, err := listenUnix(path, perm)
+	if err != nil {
+		log.Error(fmt.Sprintf("while binding to socket %#q, got error %#q", path, err))
+		panic(err)
+	}
+
+	return func() (client.Interface, error) {
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		return conn, nil
+	}
+}
+
+// listenUnix binds to a socket file in a private directory next to the given
+// path, sets its permissions and moves it to the given path, so that the socket
+// file is never accessible with the broader permissions of the umask.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".socket")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(path))
+
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(tmp, perm); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	// The socket file has moved, closing the listener shouldn't remove it.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file at the given path
+// if nothing is listening on it anymore.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case info.Mode()&os.ModeSocket == 0:
+		return NotASocketError
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+
+		return SocketInUseError
+	}
+
+	log.Info(fmt.Sprintf("Removing stale socket %#q", path))
+
+	return os.Remove(path)
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"../log"
+)
+
+var UnsupportedSocketError = errors.New("unix domain sockets aren't supported on this platform")
+
+// Unix throws a panic, since Unix domain sockets aren't supported on this platform.
+func Unix(path string, perm os.FileMode) Listener {
+	log.Error(fmt.Sprintf("while binding to socket %#q, got error %#q", path, UnsupportedSocketError))
+	panic(UnsupportedSocketError)
+}
@@ -0,0 +1,102 @@
+//go:build unix
+
+package protocol_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"."
+)
+
+func TestAcceptsUnixConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.sock")
+
+	// A previous process crashed and left its socket behind.
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("syscall.Socket got error %v", err)
+	}
+
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		t.Fatalf("syscall.Bind(%#q) got error %v", path, err)
+	}
+
+	syscall.Close(fd)
+
+	accept := protocol.Unix(path, 0660)
+
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 1 {
+		t.Errorf("protocol.Unix(%#q, 0660) expected only the socket file in %#q, got %v with error %v", path, dir, len(files), err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat(%#q) got error %v", path, err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0660 {
+		t.Errorf("protocol.Unix(%#q, 0660) expected socket permissions %v, got %v", path, os.FileMode(0660), perm)
+	}
+
+	msg := "1|B\r\n"
+
+	go func() {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Errorf("net.Dial(unix, %#q) got error %v", path, err)
+			return
+		}
+		defer conn.Close()
+
+		io.WriteString(conn, msg)
+	}()
+
+	conn, err := accept()
+	if err != nil {
+		t.Fatalf("protocol.Unix(%#q) got error %v", path, err)
+	}
+	defer conn.Close()
+
+	if got, err := bufio.NewReader(conn).ReadString('\n'); err != nil || got != msg {
+		t.Errorf("protocol.Unix(%#q) expected to read %#q, got %#q and error %v", path, msg, got, err)
+	}
+}
+
+func TestRefusesToReplaceOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.sock")
+
+	if err := ioutil.WriteFile(path, []byte("important"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := recover(); err != protocol.NotASocketError {
+			t.Errorf("protocol.Unix(%#q) expected to panic with %v, got %v", path, protocol.NotASocketError, err)
+		}
+
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("protocol.Unix(%#q) expected the file to be kept, got error %v", path, err)
+		}
+	}()
+
+	protocol.Unix(path, 0660)
+}
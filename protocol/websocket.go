@@ -0,0 +1,458 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"../client"
+	"../log"
+)
+
+// MaxWebSocketMessage is the maximum size of a message a WebSocket client may send.
+var MaxWebSocketMessage = 4096
+
+// websocketGUID is used for computing the Sec-WebSocket-Accept header as defined in RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// WebSocket close status codes
+const (
+	closeNormal          = 1000
+	closeProtocolError   = 1002
+	closeUnsupportedData = 1003
+	closeInvalidPayload  = 1007
+	closeMessageTooBig   = 1009
+)
+
+var WebSocketProtocolError = errors.New("websocket client violated the protocol")
+
+// WebSocket creates a listener on the given address that upgrades the HTTP
+// requests for the given path to WebSocket connections (RFC 6455), e.g. for
+// browsers. Each text message a client sends is read as a CRLF terminated line
+// and each write is sent as a text message without its line terminator, or as a
+// binary message if it isn't valid UTF-8, so WebSocket clients are served
+// exactly like TCP clients.
+//
+// Browsers send the origin of the page that opens a WebSocket, requests from
+// other origins than the given ones, e.g. `https://example.com`, are rejected
+// so that other web pages can't connect on behalf of their visitors.
+// Without any origins only same-origin requests are accepted and `*` accepts
+// every origin. Requests without an origin, i.e. not from browsers, are accepted.
+// Throws a panic if binding is unsuccessful.
+func WebSocket(addr, path string, origins ...string) Listener {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error(fmt.Sprintf("while binding to address %#q, got error %#q", addr, err))
+		panic(err)
+	}
+
+	return WebSocketOn(listener, path, origins...)
+}
+
+// WebSocketOn creates a listener like WebSocket that serves the requests
+// of the given bound listener, e.g. one bound to an ephemeral port.
+func WebSocketOn(listener net.Listener, path string, origins ...string) Listener {
+	connCh, errCh := make(chan client.Interface), make(chan error, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if !isAllowedOrigin(r, origins) {
+			http.Error(w, "forbidden origin", http.StatusForbidden)
+
+			log.Debug(fmt.Sprintf("protocol.WebSocket: rejected a request from origin %#q", r.Header.Get("Origin")))
+			return
+		}
+
+		conn, err := upgrade(w, r)
+		if err != nil {
+			log.Debug(fmt.Sprintf("protocol.WebSocket: while upgrading a connection, got error %#q", err))
+			return
+		}
+
+		connCh <- conn
+	})
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: TCP_TIMEOUT,
+	}
+
+	go func() {
+		errCh <- srv.Serve(listener)
+	}()
+
+	return func() (client.Interface, error) {
+		select {
+		case conn := <-connCh:
+			return conn, nil
+		case err := <-errCh:
+			return nil, err
+		}
+	}
+}
+
+// isAllowedOrigin reports whether the origin of the given request is one of the
+// given origins, or the same as the requested host if there aren't any.
+func isAllowedOrigin(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if len(origins) == 0 {
+		u, err := url.Parse(origin)
+
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, o := range origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasToken reports whether the comma separated header values contain the given token.
+func hasToken(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// acceptKey computes the Sec-WebSocket-Accept header for the given Sec-WebSocket-Key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// upgrade completes the opening handshake and takes over the connection of the request.
+func upgrade(w http.ResponseWriter, r *http.Request) (*WebSocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	switch {
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, WebSocketProtocolError
+	case !hasToken(r.Header, "Connection", "upgrade") || !hasToken(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, WebSocketProtocolError
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, WebSocketProtocolError
+	}
+
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		http.Error(w, "invalid websocket key", http.StatusBadRequest)
+		return nil, WebSocketProtocolError
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, WebSocketProtocolError
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// Clears the deadlines set by the HTTP server.
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %v\r\n\r\n", acceptKey(key))
+
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &WebSocketConn{Conn: conn, rdr: rw.Reader}, nil
+}
+
+// WebSocketConn is a connection accepted by a WebSocket listener.
+// Reads return the text messages of the client as CRLF terminated lines
+// and each write is sent as a text message, or a binary one if it isn't UTF-8.
+type WebSocketConn struct {
+	net.Conn
+
+	rdr *bufio.Reader
+
+	// pending is the unread part of the current message.
+	pending []byte
+
+	// mu serializes the frames written by the reader and the writer.
+	mu            sync.Mutex
+	writeDeadline time.Time
+
+	closeOnce sync.Once
+}
+
+// Read reads the text messages of the client as CRLF terminated lines.
+// Control frames are handled transparently.
+func (c *WebSocketConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		c.pending = append(msg, '\r', '\n')
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// Write sends the given payload as a text message without its line terminator.
+// Payloads that aren't valid UTF-8, e.g. events with binary bodies, are sent as
+// binary messages instead, since clients fail the connection on invalid text.
+func (c *WebSocketConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	payload := bytes.TrimSuffix(bytes.TrimSuffix(p, []byte("\n")), []byte("\r"))
+
+	opcode := byte(opText)
+	if !utf8.Valid(payload) {
+		opcode = opBinary
+	}
+
+	if err := c.writeFrame(opcode, payload, deadline); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// SetWriteDeadline sets the deadline for the messages written with Write.
+// Control frames use their own deadline, so that an idle connection can still answer pings.
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+
+	return nil
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *WebSocketConn) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Close sends a close frame to the client and closes the connection.
+func (c *WebSocketConn) Close() error {
+	err := net.ErrClosed
+
+	c.closeOnce.Do(func() {
+		c.writeClose(closeNormal)
+
+		err = c.Conn.Close()
+	})
+
+	return err
+}
+
+// writeClose sends a close frame with the given status code.
+func (c *WebSocketConn) writeClose(code uint16) error {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+
+	return c.writeFrame(opClose, payload[:], time.Now().Add(TCP_TIMEOUT))
+}
+
+// fail sends a close frame with the given status code and returns WebSocketProtocolError.
+func (c *WebSocketConn) fail(code uint16) error {
+	c.writeClose(code)
+
+	return WebSocketProtocolError
+}
+
+// writeFrame writes a single unmasked frame with the given deadline.
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte, deadline time.Time) error {
+	header := make([]byte, 2, 10+len(payload))
+	header[0] = 0x80 | opcode
+
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = append(header, byte(n>>8), byte(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Conn.SetWriteDeadline(deadline)
+
+	_, err := c.Conn.Write(append(header, payload...))
+
+	return err
+}
+
+// readFrame reads a single masked frame sent by the client.
+func (c *WebSocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.rdr, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0F
+
+	// Extensions aren't negotiated and clients have to mask their frames.
+	if header[0]&0x70 != 0 || header[1]&0x80 == 0 {
+		return false, 0, nil, c.fail(closeProtocolError)
+	}
+
+	n := uint64(header[1] & 0x7F)
+
+	switch n {
+	case 126:
+		var size [2]byte
+		if _, err := io.ReadFull(c.rdr, size[:]); err != nil {
+			return false, 0, nil, err
+		}
+
+		n = uint64(binary.BigEndian.Uint16(size[:]))
+	case 127:
+		var size [8]byte
+		if _, err := io.ReadFull(c.rdr, size[:]); err != nil {
+			return false, 0, nil, err
+		}
+
+		n = binary.BigEndian.Uint64(size[:])
+	}
+
+	// Control frames can't be fragmented or longer than 125 bytes.
+	if opcode >= opClose && (!fin || n > 125) {
+		return false, 0, nil, c.fail(closeProtocolError)
+	}
+
+	if n > uint64(MaxWebSocketMessage) {
+		return false, 0, nil, c.fail(closeMessageTooBig)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rdr, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.rdr, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// readMessage reads frames until a complete text message is received.
+// It answers pings and returns io.EOF once the client closes the connection.
+func (c *WebSocketConn) readMessage() ([]byte, error) {
+	var (
+		msg       []byte
+		isStarted bool
+	)
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opClose:
+			// A close payload starts with a 2 byte status code, if any.
+			if len(payload) == 1 {
+				return nil, c.fail(closeProtocolError)
+			}
+
+			// Echoes the status code of the client.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+
+			c.writeFrame(opClose, payload, time.Now().Add(TCP_TIMEOUT))
+			return nil, io.EOF
+		case opPing:
+			c.writeFrame(opPong, payload, time.Now().Add(TCP_TIMEOUT))
+			continue
+		case opPong:
+			continue
+		case opText:
+			if isStarted {
+				return nil, c.fail(closeProtocolError)
+			}
+
+			msg, isStarted = payload, true
+		case opContinuation:
+			if !isStarted {
+				return nil, c.fail(closeProtocolError)
+			}
+
+			msg = append(msg, payload...)
+		case opBinary:
+			return nil, c.fail(closeUnsupportedData)
+		default:
+			return nil, c.fail(closeProtocolError)
+		}
+
+		if len(msg) > MaxWebSocketMessage {
+			return nil, c.fail(closeMessageTooBig)
+		}
+
+		if fin {
+			if !utf8.Valid(msg) {
+				return nil, c.fail(closeInvalidPayload)
+			}
+
+			return msg, nil
+		}
+	}
+}
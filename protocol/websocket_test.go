@@ -0,0 +1,313 @@
+package protocol_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"."
+	"../client"
+)
+
+// Sample nonce from RFC 6455.
+const sampleKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// listenWebSocket serves WebSockets at /events on an ephemeral port.
+func listenWebSocket(t *testing.T, origins ...string) (addr string, accept protocol.Listener, closer io.Closer) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen got error %v", err)
+	}
+
+	return l.Addr().String(), protocol.WebSocketOn(l, "/events", origins...), l
+}
+
+// requestUpgrade sends an opening handshake with the given headers
+// and returns the response of the server.
+func requestUpgrade(t *testing.T, addr string, headers string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial(tcp, %#q) got error %v", addr, err)
+	}
+
+	io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: "+addr+"\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Key: "+sampleKey+"\r\nSec-WebSocket-Version: 13\r\n"+headers+"\r\n")
+
+	rdr := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(rdr, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse got error %v", err)
+	}
+
+	return conn, rdr, resp
+}
+
+// dialWebSocket completes the opening handshake and returns both ends of the connection.
+func dialWebSocket(t *testing.T, addr string, accept protocol.Listener) (net.Conn, *bufio.Reader, client.Interface) {
+	conn, rdr, resp := requestUpgrade(t, addr, "")
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("protocol.WebSocket expected status %v, got %v", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	ws, err := accept()
+	if err != nil {
+		t.Fatalf("protocol.WebSocket accept got error %v", err)
+	}
+
+	return conn, rdr, ws
+}
+
+// writeFrame writes a masked client frame.
+func writeFrame(w io.Writer, fin bool, opcode byte, payload string) {
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+
+	frame := []byte{opcode, 0x80 | byte(len(payload))}
+	if fin {
+		frame[0] |= 0x80
+	}
+
+	frame = append(frame, mask[:]...)
+
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+
+	w.Write(frame)
+}
+
+// readFrame reads a short unmasked server frame.
+func readFrame(r io.Reader) (opcode byte, payload string, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, "", err
+	}
+
+	buf := make([]byte, header[1]&0x7F)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, "", err
+	}
+
+	return header[0] & 0x0F, string(buf), nil
+}
+
+// expectClose reads the next server frame and checks that it closes with the given status code.
+func expectClose(t *testing.T, r io.Reader, code uint16) {
+	opcode, payload, err := readFrame(r)
+	if err != nil || opcode != 0x8 || len(payload) != 2 || binary.BigEndian.Uint16([]byte(payload)) != code {
+		t.Errorf("protocol.WebSocket expected a close frame with %v, got opcode %v with %#q and error %v", code, opcode, payload, err)
+	}
+}
+
+func TestAcceptsWebSocketConnections(t *testing.T) {
+	addr, accept, l := listenWebSocket(t)
+	defer l.Close()
+
+	conn, rdr, ws := dialWebSocket(t, addr, accept)
+	defer conn.Close()
+	defer ws.Close()
+
+	writeFrame(conn, true, 0x1, "2932")
+
+	line, err := bufio.NewReader(ws).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading a text message got error %v", err)
+	}
+
+	if expected := "2932\r\n"; line != expected {
+		t.Errorf("protocol.WebSocket expected text messages to be read as %#q, got %#q", expected, line)
+	}
+
+	io.WriteString(ws, "1|B\r\n")
+
+	if opcode, payload, err := readFrame(rdr); err != nil || opcode != 0x1 || payload != "1|B" {
+		t.Errorf("protocol.WebSocket expected a text message with %#q, got opcode %v with %#q and error %v", "1|B", opcode, payload, err)
+	}
+
+	io.WriteString(ws, "2|P|12|13|\xff\r\n")
+
+	if opcode, payload, err := readFrame(rdr); err != nil || opcode != 0x2 || payload != "2|P|12|13|\xff" {
+		t.Errorf("protocol.WebSocket expected a binary message with %#q, got opcode %v with %#q and error %v", "2|P|12|13|\xff", opcode, payload, err)
+	}
+}
+
+func TestReadsFragmentedWebSocketMessages(t *testing.T) {
+	addr, accept, l := listenWebSocket(t)
+	defer l.Close()
+
+	conn, rdr, ws := dialWebSocket(t, addr, accept)
+	defer conn.Close()
+	defer ws.Close()
+
+	// Control frames may be interleaved with the fragments of a message.
+	writeFrame(conn, false, 0x1, "29")
+	writeFrame(conn, true, 0x9, "ping")
+	writeFrame(conn, true, 0xA, "unsolicited")
+	writeFrame(conn, false, 0x0, "3")
+	writeFrame(conn, true, 0x0, "2")
+
+	line, err := bufio.NewReader(ws).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading a fragmented message got error %v", err)
+	}
+
+	if expected := "2932\r\n"; line != expected {
+		t.Errorf("protocol.WebSocket expected fragments to be read as %#q, got %#q", expected, line)
+	}
+
+	if opcode, payload, err := readFrame(rdr); err != nil || opcode != 0xA || payload != "ping" {
+		t.Errorf("protocol.WebSocket expected a pong with %#q, got opcode %v with %#q and error %v", "ping", opcode, payload, err)
+	}
+}
+
+func TestEchoesWebSocketCloseFrames(t *testing.T) {
+	addr, accept, l := listenWebSocket(t)
+	defer l.Close()
+
+	conn, rdr, ws := dialWebSocket(t, addr, accept)
+	defer conn.Close()
+	defer ws.Close()
+
+	// Going away, with a reason that isn't echoed.
+	writeFrame(conn, true, 0x8, string([]byte{0x03, 0xE9})+"bye")
+
+	if _, err := ws.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("protocol.WebSocket expected io.EOF after the client closes, got %v", err)
+	}
+
+	expectClose(t, rdr, 1001)
+}
+
+func TestRejectsInvalidWebSocketFrames(t *testing.T) {
+	defer func(max int) { protocol.MaxWebSocketMessage = max }(protocol.MaxWebSocketMessage)
+	protocol.MaxWebSocketMessage = 8
+
+	tests := []struct {
+		desc   string
+		frames func(w io.Writer)
+		code   uint16
+	}{
+		{"an oversized frame", func(w io.Writer) {
+			writeFrame(w, true, 0x1, "123456789")
+		}, 1009},
+		{"an oversized fragmented message", func(w io.Writer) {
+			writeFrame(w, false, 0x1, "12345")
+			writeFrame(w, true, 0x0, "6789")
+		}, 1009},
+		{"an unmasked frame", func(w io.Writer) {
+			w.Write([]byte{0x81, 0x01, '1'})
+		}, 1002},
+		{"a fragmented control frame", func(w io.Writer) {
+			writeFrame(w, false, 0x9, "ping")
+		}, 1002},
+		{"a close frame with a partial status code", func(w io.Writer) {
+			writeFrame(w, true, 0x8, "\x03")
+		}, 1002},
+		{"an unexpected continuation frame", func(w io.Writer) {
+			writeFrame(w, true, 0x0, "1")
+		}, 1002},
+		{"a binary frame", func(w io.Writer) {
+			writeFrame(w, true, 0x2, "1")
+		}, 1003},
+		{"an invalid UTF-8 message", func(w io.Writer) {
+			writeFrame(w, true, 0x1, "\xff")
+		}, 1007},
+	}
+
+	addr, accept, l := listenWebSocket(t)
+	defer l.Close()
+
+	for _, test := range tests {
+		conn, rdr, ws := dialWebSocket(t, addr, accept)
+
+		test.frames(conn)
+
+		if _, err := ws.Read(make([]byte, 1)); err != protocol.WebSocketProtocolError {
+			t.Errorf("protocol.WebSocket expected %v after %v, got %v", protocol.WebSocketProtocolError, test.desc, err)
+		}
+
+		expectClose(t, rdr, test.code)
+
+		ws.Close()
+		conn.Close()
+	}
+}
+
+func TestRejectsPlainHTTPRequests(t *testing.T) {
+	addr, _, l := listenWebSocket(t)
+	defer l.Close()
+
+	resp, err := http.Get("http://" + addr + "/events")
+	if err != nil {
+		t.Fatalf("http.Get got error %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("protocol.WebSocket expected plain HTTP requests to be rejected with %v, got %v", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestComputesWebSocketAcceptKey(t *testing.T) {
+	addr, accept, l := listenWebSocket(t)
+	defer l.Close()
+
+	go func() {
+		if ws, err := accept(); err == nil {
+			ws.Close()
+		}
+	}()
+
+	conn, _, resp := requestUpgrade(t, addr, "")
+	defer conn.Close()
+
+	// Expected value from RFC 6455.
+	if expected, got := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"); expected != got {
+		t.Errorf("protocol.WebSocket expected Sec-WebSocket-Accept %#q, got %#q", expected, got)
+	}
+}
+
+func TestChecksWebSocketOrigins(t *testing.T) {
+	tests := []struct {
+		origins []string
+		origin  string
+		status  int
+	}{
+		{nil, "", http.StatusSwitchingProtocols},
+		{nil, "http://{{addr}}", http.StatusSwitchingProtocols},
+		{nil, "https://example.com", http.StatusForbidden},
+		{nil, "null", http.StatusForbidden},
+		{[]string{"https://example.com"}, "https://EXAMPLE.com", http.StatusSwitchingProtocols},
+		{[]string{"https://example.com"}, "https://example.com.evil.org", http.StatusForbidden},
+		{[]string{"https://example.com"}, "http://{{addr}}", http.StatusForbidden},
+		{[]string{"*"}, "https://evil.org", http.StatusSwitchingProtocols},
+	}
+
+	for _, test := range tests {
+		addr, accept, l := listenWebSocket(t, test.origins...)
+
+		go func() {
+			if ws, err := accept(); err == nil {
+				ws.Close()
+			}
+		}()
+
+		var header string
+		if test.origin != "" {
+			header = "Origin: " + strings.Replace(test.origin, "{{addr}}", addr, 1) + "\r\n"
+		}
+
+		conn, _, resp := requestUpgrade(t, addr, header)
+
+		if resp.StatusCode != test.status {
+			t.Errorf("protocol.WebSocket with origins %q expected a request from %#q to get %v, got %v", test.origins, test.origin, test.status, resp.StatusCode)
+		}
+
+		conn.Close()
+		l.Close()
+	}
+}
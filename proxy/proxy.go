@@ -0,0 +1,333 @@
+// Package proxy contains utilities for forwarding the event stream to
+// upstream event-queue servers, so that the server can be used as a
+// validating edge in front of other servers.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"../client"
+	"../event"
+	"../log"
+	"../protocol"
+)
+
+// OverflowPolicy denotes what to do with a payload when the buffer of an upstream is full.
+type OverflowPolicy int
+
+const (
+	// DropPolicy drops the payload that doesn't fit.
+	DropPolicy OverflowPolicy = iota
+
+	// DisconnectPolicy drops the connection to the upstream along with the
+	// buffered payloads and reconnects, e.g. so that a stuck connection is replaced.
+	DisconnectPolicy
+)
+
+var (
+	// Buffer is the number of payloads kept for an upstream while it's unreachable
+	// or slow. Forwarding never blocks, payloads that don't fit are handled
+	// according to Overflow.
+	Buffer = 1 << 16
+
+	// Overflow decides what happens when the buffer of an upstream is full.
+	// It's captured by NewUpstream, so each upstream keeps its own policy.
+	Overflow = DropPolicy
+
+	// RetryInterval is how long to wait before reconnecting to an upstream,
+	// it doubles after every failed attempt up to MaxRetryInterval.
+	RetryInterval    = 100 * time.Millisecond
+	MaxRetryInterval = 10 * time.Second
+
+	// maxBatchSize is the approximate maximum number of bytes written at once.
+	maxBatchSize = 64 << 10
+)
+
+// counters keeps the forwarding statistics, e.g. number of reconnections.
+var counters = expvar.NewMap("proxy")
+
+// Upstream forwards payloads to an upstream server over TCP in order.
+// A batch that fails to be written is sent again after reconnecting and
+// upstream servers ignore the duplicates. Since upstreams don't acknowledge
+// anything, payloads already accepted by the kernel when a connection
+// dies are lost.
+type Upstream struct {
+	addr     string
+	overflow OverflowPolicy
+
+	retryInterval, maxRetryInterval time.Duration
+
+	// mu guards payloadCh against Send calls after Close.
+	mu       sync.RWMutex
+	isClosed bool
+
+	payloadCh chan []byte
+	doneCh    chan struct{}
+
+	// resetCh requests the connection and the buffer to be dropped.
+	resetCh chan struct{}
+
+	// closeCh stops the reconnection attempts once Close is called.
+	closeCh chan struct{}
+}
+
+// NewUpstream creates an Upstream that connects to the given address
+// and keeps reconnecting until it's closed.
+func NewUpstream(addr string) *Upstream {
+	u := &Upstream{
+		addr:             addr,
+		overflow:         Overflow,
+		retryInterval:    RetryInterval,
+		maxRetryInterval: MaxRetryInterval,
+		payloadCh:        make(chan []byte, Buffer),
+		doneCh:           make(chan struct{}),
+		resetCh:          make(chan struct{}, 1),
+		closeCh:          make(chan struct{}),
+	}
+
+	go u.run()
+
+	return u
+}
+
+// Send queues the given payload for the upstream without blocking.
+// If the buffer is full, the payload is handled according to the overflow policy.
+// Payloads sent after Close are dropped.
+func (u *Upstream) Send(payload []byte) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	if u.isClosed {
+		counters.Add("dropped "+u.addr, 1)
+		return
+	}
+
+	select {
+	case u.payloadCh <- payload:
+		return
+	default:
+	}
+
+	counters.Add("dropped "+u.addr, 1)
+
+	if u.overflow == DisconnectPolicy {
+		select {
+		case u.resetCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close sends the queued payloads and closes the connection to the upstream.
+// If the upstream is unreachable, the queued payloads are dropped instead.
+func (u *Upstream) Close() error {
+	u.mu.Lock()
+
+	if u.isClosed {
+		u.mu.Unlock()
+		return nil
+	}
+
+	u.isClosed = true
+	close(u.payloadCh)
+	close(u.closeCh)
+
+	u.mu.Unlock()
+
+	<-u.doneCh
+
+	return nil
+}
+
+// reset drops the connection, the given batch and the buffered payloads,
+// so that the upstream starts over with the payloads sent afterwards.
+func (u *Upstream) reset(conn net.Conn, batch []byte) {
+	if conn != nil {
+		conn.Close()
+	}
+
+	n := int64(bytes.Count(batch, []byte("\n")))
+
+drain:
+	for {
+		select {
+		case _, ok := <-u.payloadCh:
+			if !ok {
+				break drain
+			}
+
+			n++
+		default:
+			break drain
+		}
+	}
+
+	// Overflows before the drain are handled by now.
+	select {
+	case <-u.resetCh:
+	default:
+	}
+
+	log.Error(fmt.Sprintf("proxy.Upstream: buffer of %#q is full, dropped %v payloads and reconnecting", u.addr, n))
+	counters.Add("dropped "+u.addr, n)
+	counters.Add("disconnected", 1)
+}
+
+// run writes the queued payloads to the upstream in batches.
+func (u *Upstream) run() {
+	defer close(u.doneCh)
+
+	var (
+		conn  net.Conn
+		batch []byte
+		retry = u.retryInterval
+	)
+
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		if len(batch) == 0 {
+			var (
+				payload []byte
+				ok      bool
+			)
+
+			select {
+			case payload, ok = <-u.payloadCh:
+			case <-u.resetCh:
+				u.reset(conn, nil)
+				conn = nil
+
+				continue
+			}
+
+			if !ok {
+				return
+			}
+
+			batch = append(batch, payload...)
+
+			// Gathers the payloads that are already queued.
+		gather:
+			for len(batch) < maxBatchSize {
+				select {
+				case payload, ok := <-u.payloadCh:
+					if !ok {
+						break gather
+					}
+
+					batch = append(batch, payload...)
+				default:
+					break gather
+				}
+			}
+		}
+
+		if conn == nil {
+			c, err := net.DialTimeout("tcp", u.addr, protocol.TCP_TIMEOUT)
+			if err != nil {
+				log.Error(fmt.Sprintf("proxy.Upstream: while connecting to %#q, got error %#q, retrying in %v", u.addr, err, retry))
+				counters.Add("dial errors", 1)
+
+				select {
+				case <-time.After(retry):
+				case <-u.resetCh:
+					u.reset(nil, batch)
+					batch = batch[:0]
+				case <-u.closeCh:
+					log.Error(fmt.Sprintf("proxy.Upstream: %#q is unreachable, dropped the queued payloads", u.addr))
+					return
+				}
+
+				if retry *= 2; retry > u.maxRetryInterval {
+					retry = u.maxRetryInterval
+				}
+
+				continue
+			}
+
+			log.Info(fmt.Sprintf("proxy.Upstream: connected to %#q", u.addr))
+
+			conn, retry = c, u.retryInterval
+		}
+
+		select {
+		case <-u.resetCh:
+			u.reset(conn, batch)
+			conn, batch = nil, batch[:0]
+
+			continue
+		default:
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(protocol.TCP_TIMEOUT))
+
+		if _, err := conn.Write(batch); err != nil {
+			log.Error(fmt.Sprintf("proxy.Upstream: while writing to %#q, got error %#q, reconnecting", u.addr, err))
+			counters.Add("reconnects", 1)
+
+			conn.Close()
+			conn = nil
+
+			continue
+		}
+
+		batch = batch[:0]
+	}
+}
+
+// Forward returns a function that sends every packet to each of the given
+// upstreams, e.g. as handle.OnRelease to forward the ordered stream.
+func Forward(upstreams ...*Upstream) func(event.Packet) {
+	return func(pkt event.Packet) {
+		for _, u := range upstreams {
+			u.Send(pkt.Payload())
+		}
+
+		counters.Add("forwarded", 1)
+	}
+}
+
+// Relay returns a protocol.Handler that forwards the packets of an event
+// source to each of the given upstreams as they arrive, without reordering.
+// Malformed packets are dropped.
+func Relay(upstreams ...*Upstream) protocol.Handler {
+	forward := Forward(upstreams...)
+
+	return func(conn client.Interface) error {
+		defer conn.Close()
+
+		rdr := bufio.NewReader(conn)
+
+		for {
+			payload, err := rdr.ReadBytes('\n')
+			if err == io.EOF {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			pkt, err := event.Parse(payload)
+			if err != nil {
+				log.Debug(fmt.Sprintf("proxy.Relay: dropped packet %#q, got error %#q", string(payload), err))
+				counters.Add("dropped", 1)
+				continue
+			}
+
+			forward(pkt)
+		}
+	}
+}
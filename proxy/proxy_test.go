@@ -0,0 +1,288 @@
+package proxy_test
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"."
+	"../event"
+	"../testutil"
+)
+
+// accept returns the lines sent through the next connection of the listener
+// until the given number of lines is read, then closes the connection.
+func accept(t *testing.T, l net.Listener, n int) []string {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("net.Listener.Accept() got error %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	rdr := bufio.NewReader(conn)
+
+	var lines []string
+	for len(lines) < n {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("bufio.ReadString(conn) got error %v", err)
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+func TestForwardsPacketsToUpstreams(t *testing.T) {
+	var (
+		listeners []net.Listener
+		upstreams []*proxy.Upstream
+	)
+
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("net.Listen got error %v", err)
+		}
+		defer l.Close()
+
+		listeners = append(listeners, l)
+		upstreams = append(upstreams, proxy.NewUpstream(l.Addr().String()))
+	}
+
+	forward := proxy.Forward(upstreams...)
+
+	payloads := []string{"1|B\r\n", "2|F|12|13\r\n", "3|S|12\r\n"}
+	for _, p := range payloads {
+		pkt, err := event.Parse([]byte(p))
+		if err != nil {
+			t.Fatalf("event.Parse(%#q) got error %v", p, err)
+		}
+
+		forward(pkt)
+	}
+
+	for i, l := range listeners {
+		for j, got := range accept(t, l, len(payloads)) {
+			if expected := payloads[j]; expected != got {
+				t.Errorf("proxy.Forward => upstream %v expected %#q, got %#q", i, expected, got)
+			}
+		}
+	}
+
+	for _, u := range upstreams {
+		u.Close()
+	}
+}
+
+func TestReconnectsToUpstream(t *testing.T) {
+	defer func(interval time.Duration) {
+		proxy.RetryInterval = interval
+	}(proxy.RetryInterval)
+
+	proxy.RetryInterval = time.Millisecond
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen got error %v", err)
+	}
+	defer l.Close()
+
+	u := proxy.NewUpstream(l.Addr().String())
+	defer u.Close()
+
+	u.Send([]byte("1|B\r\n"))
+
+	// The upstream goes away after the first packet.
+	if got := accept(t, l, 1); got[0] != "1|B\r\n" {
+		t.Errorf("proxy.Upstream expected %#q, got %#q", "1|B\r\n", got[0])
+	}
+
+	lineCh := make(chan string, 16)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rdr := bufio.NewReader(conn)
+		for {
+			line, err := rdr.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			lineCh <- line
+		}
+	}()
+
+	// Writes may succeed until the closed connection is noticed.
+	for deadline := time.After(time.Second); ; {
+		u.Send([]byte("2|B\r\n"))
+
+		select {
+		case line := <-lineCh:
+			if line != "2|B\r\n" {
+				t.Errorf("proxy.Upstream expected %#q after reconnecting, got %#q", "2|B\r\n", line)
+			}
+			return
+		case <-deadline:
+			t.Fatal("proxy.Upstream should have reconnected to the upstream")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestRelaysValidPackets(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen got error %v", err)
+	}
+	defer l.Close()
+
+	u := proxy.NewUpstream(l.Addr().String())
+	defer u.Close()
+
+	conn, source := net.Pipe()
+
+	go func() {
+		source.Write([]byte("3|B\r\nmalformed\r\n1|B\r\n"))
+		source.Close()
+	}()
+
+	if err := proxy.Relay(u)(conn); err != nil {
+		t.Errorf("proxy.Relay got error %v", err)
+	}
+
+	lines := accept(t, l, 2)
+
+	for i, expected := range []string{"3|B\r\n", "1|B\r\n"} {
+		if got := lines[i]; expected != got {
+			t.Errorf("proxy.Relay expected %#q, got %#q", expected, got)
+		}
+	}
+}
+
+func counter(name string) int64 {
+	return testutil.Counter("proxy", name)
+}
+
+// unreachable returns an address that refuses connections.
+func unreachable(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen got error %v", err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func TestAppliesOverflowPolicy(t *testing.T) {
+	defer func(buffer int, interval time.Duration, overflow proxy.OverflowPolicy) {
+		proxy.Buffer, proxy.RetryInterval, proxy.Overflow = buffer, interval, overflow
+	}(proxy.Buffer, proxy.RetryInterval, proxy.Overflow)
+
+	proxy.Buffer, proxy.RetryInterval = 2, time.Hour
+
+	for _, policy := range []proxy.OverflowPolicy{proxy.DropPolicy, proxy.DisconnectPolicy} {
+		proxy.Overflow = policy
+
+		addr := unreachable(t)
+		u := proxy.NewUpstream(addr)
+
+		dropped, disconnected := counter("dropped "+addr), counter("disconnected")
+
+		// Sending to a dead upstream shouldn't block.
+		for i := 0; i < 100; i++ {
+			u.Send([]byte("1|B\r\n"))
+		}
+
+		if counter("dropped "+addr) == dropped {
+			t.Errorf("proxy.Upstream with overflow policy %v expected to drop payloads", policy)
+		}
+
+		if policy == proxy.DisconnectPolicy {
+			for deadline := time.Now().Add(time.Second); counter("disconnected") == disconnected && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		// Closing shouldn't wait for the retry interval of an unreachable upstream.
+		u.Close()
+
+		if got := counter("disconnected") - disconnected; policy == proxy.DisconnectPolicy && got == 0 || policy == proxy.DropPolicy && got != 0 {
+			t.Errorf("proxy.Upstream with overflow policy %v disconnected %v times", policy, got)
+		}
+
+		// Sending after Close shouldn't panic.
+		u.Send([]byte("2|B\r\n"))
+	}
+}
+
+func TestReconnectsAfterOverflow(t *testing.T) {
+	defer func(buffer int, interval, maxInterval time.Duration, overflow proxy.OverflowPolicy) {
+		proxy.Buffer, proxy.RetryInterval, proxy.MaxRetryInterval, proxy.Overflow = buffer, interval, maxInterval, overflow
+	}(proxy.Buffer, proxy.RetryInterval, proxy.MaxRetryInterval, proxy.Overflow)
+
+	proxy.Buffer, proxy.RetryInterval, proxy.MaxRetryInterval = 2, time.Millisecond, 10*time.Millisecond
+	proxy.Overflow = proxy.DisconnectPolicy
+
+	addr := unreachable(t)
+	u := proxy.NewUpstream(addr)
+	defer u.Close()
+
+	disconnected := counter("disconnected")
+
+	for counter("disconnected") == disconnected {
+		u.Send([]byte("1|B\r\n"))
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Listen(tcp, %#q) got error %v", addr, err)
+	}
+	defer l.Close()
+
+	// Keeps sending, since the payloads might be dropped by a reset in progress.
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	go func() {
+		for {
+			u.Send([]byte("2|B\r\n"))
+
+			select {
+			case <-doneCh:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("net.Listener.Accept() got error %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	// Payloads sent before the reset was handled might precede it.
+	rdr := bufio.NewReader(conn)
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("proxy.Upstream expected to forward %#q after reconnecting, got error %v", "2|B\r\n", err)
+		}
+
+		if line == "2|B\r\n" {
+			break
+		}
+	}
+}
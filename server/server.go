@@ -3,6 +3,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 
 	"../log"
@@ -14,10 +15,6 @@ import (
 // Listen uses the given protocol.Listener to accept connections and protocol.Handler
 // to handle those connections.
 func Listen(accept protocol.Listener, handle protocol.Handler) error {
-	// TODO(tmrts): Make protocol.Listener a variadic argument for allowing
-	//              a user to listen on multiple ports/protocols with few lines of code.
-	// TODO(tmrts); server.Listen(protocol.TCP(addr1), protocol.TCP(addr2), handleFunc, upstreamPort)
-	//              can be used as a simple reverse proxy as well
 	for {
 		c, err := accept()
 		if err != nil {
@@ -32,6 +29,32 @@ func Listen(accept protocol.Listener, handle protocol.Handler) error {
 			}
 		}(c)
 	}
+}
+
+// ListenAll accepts connections from every given protocol.Listener and handles
+// them with the same protocol.Handler, e.g.
+//
+//	server.ListenAll(handle, protocol.TCP(addr1), protocol.TCP(addr2))
+//
+// A failing listener doesn't affect the others. ListenAll returns the errors
+// of the listeners once every one of them has failed.
+func ListenAll(handle protocol.Handler, listeners ...protocol.Listener) error {
+	errCh := make(chan error, len(listeners))
+
+	for _, accept := range listeners {
+		go func(accept protocol.Listener) {
+			err := Listen(accept, handle)
+
+			log.Error(fmt.Sprintf("server.ListenAll: a listener stopped, got error %#q", err))
+
+			errCh <- err
+		}(accept)
+	}
+
+	var errs []error
+	for range listeners {
+		errs = append(errs, <-errCh)
+	}
 
-	return nil
+	return errors.Join(errs...)
 }
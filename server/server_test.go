@@ -2,12 +2,14 @@ package server_test
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"testing"
 
 	"."
 	"../client"
+	"../protocol"
 )
 
 type msgBuffer struct {
@@ -47,3 +49,54 @@ func TestListensOnProtocol(t *testing.T) {
 		t.Errorf("server.Listen(listener, reader) expected message %#q, got %#q", expectedMsg, msg)
 	}
 }
+
+func TestListensOnMultipleProtocols(t *testing.T) {
+	messages := []string{"first listener\n", "second listener\n"}
+
+	var listeners []protocol.Listener
+	for _, msg := range messages {
+		// Each listener accepts a single connection and then fails.
+		accepted := false
+		msg := msg
+
+		listeners = append(listeners, func() (client.Interface, error) {
+			if accepted {
+				return nil, errors.New("listener is closed")
+			}
+
+			accepted = true
+
+			return msgBuffer{Buffer: bytes.NewBufferString(msg)}, nil
+		})
+	}
+
+	msgChan := make(chan string, len(messages))
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.ListenAll(func(c client.Interface) error {
+			buf, err := ioutil.ReadAll(c)
+			if err != nil {
+				return err
+			}
+
+			msgChan <- string(buf)
+
+			return nil
+		}, listeners...)
+	}()
+
+	if err := <-errCh; err == nil {
+		t.Errorf("server.ListenAll expected an error once every listener failed, got none")
+	}
+
+	received := make(map[string]bool)
+	for range messages {
+		received[<-msgChan] = true
+	}
+
+	for _, msg := range messages {
+		if !received[msg] {
+			t.Errorf("server.ListenAll expected message %#q to be handled despite the other listener failing", msg)
+		}
+	}
+}
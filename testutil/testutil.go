@@ -0,0 +1,23 @@
+// Package testutil contains helpers that are shared
+// by the tests of the other packages.
+package testutil
+
+import (
+	"expvar"
+)
+
+// Counter returns the value of the named counter in the expvar map
+// published under the given name, or zero if it doesn't exist yet.
+func Counter(mapName, name string) int64 {
+	m, ok := expvar.Get(mapName).(*expvar.Map)
+	if !ok {
+		return 0
+	}
+
+	n, ok := m.Get(name).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+
+	return n.Value()
+}